@@ -1,6 +1,7 @@
 package metrics
 
 import (
+	"errors"
 	"sync"
 
 	zapp_metrics "github.com/zly-app/zapp/component/metrics"
@@ -22,6 +23,9 @@ type clientCli struct {
 
 	histogramCollector       map[string]zapp_metrics.IHistogram // 直方图
 	histogramCollectorLocker sync.RWMutex
+
+	signatures       map[string]*metricSignature // 已注册的指标签名
+	signaturesLocker sync.Mutex
 }
 
 func NewClient(meter metric.Meter) zapp_metrics.Client {
@@ -30,33 +34,47 @@ func NewClient(meter metric.Meter) zapp_metrics.Client {
 		counterCollector:   make(map[string]zapp_metrics.ICounter),
 		gaugeCollector:     make(map[string]zapp_metrics.IGauge),
 		histogramCollector: make(map[string]zapp_metrics.IHistogram),
+		signatures:         make(map[string]*metricSignature),
 	}
 }
 
 func (c *clientCli) RegistryCounter(name, help string, constLabels zapp_metrics.Labels, labels ...string) zapp_metrics.ICounter {
+	ret, err := c.TryRegistryCounter(name, help, constLabels, labels...)
+	var conflictErr *RegistryConflictError
+	if errors.As(err, &conflictErr) {
+		log.Fatal("Register the metrics Counter repeatedly", zap.String("name", name), zap.String("help", help), zap.Error(err))
+	}
+	if err != nil {
+		log.Warn("Register the metrics Counter fail.", zap.String("name", name), zap.String("help", help), zap.Error(err))
+		return zapp_metrics.DefNoopClient.Counter(name)
+	}
+	return ret
+}
+func (c *clientCli) TryRegistryCounter(name, help string, constLabels zapp_metrics.Labels, labels ...string) (zapp_metrics.ICounter, error) {
 	c.counterCollectorLocker.Lock()
 	defer c.counterCollectorLocker.Unlock()
 
-	if _, ok := c.counterCollector[name]; ok {
-		log.Fatal("Register the metrics Counter repeatedly", zap.String("name", name), zap.String("help", help))
+	err := c.claimMetricName(name, newMetricSignature(metricTypeCounter, help, nil, constLabels, labels))
+	if err != nil {
+		return nil, err
+	}
+	if ret, ok := c.counterCollector[name]; ok {
+		return ret, nil
 	}
 
 	counter, err := c.meter.Float64Counter(name, metric.WithDescription(help))
-	var ret zapp_metrics.ICounter
-	if err != nil {
-		log.Warn("Register the metrics Counter fail.", zap.String("name", name), zap.String("help", help), zap.Error(err))
-		ret = zapp_metrics.DefNoopClient.Counter(name)
-	} else {
-		ret = &counterCli{
-			name:       name,
-			constLabel: genLabels(constLabels),
-			counter:    counter,
-		}
+	if err != nil { // 缓存空实现, 重复注册时不再重试和输出日志
+		noop := zapp_metrics.DefNoopClient.Counter(name)
+		c.counterCollector[name] = noop
+		return noop, err
+	}
+	ret := &counterCli{
+		name:       name,
+		constLabel: genLabels(constLabels),
+		counter:    counter,
 	}
-
 	c.counterCollector[name] = ret
-	return ret
-
+	return ret, nil
 }
 func (c *clientCli) Counter(name string) zapp_metrics.ICounter {
 	c.counterCollectorLocker.RLock()
@@ -71,29 +89,43 @@ func (c *clientCli) Counter(name string) zapp_metrics.ICounter {
 }
 
 func (c *clientCli) RegistryGauge(name, help string, constLabels zapp_metrics.Labels, labels ...string) zapp_metrics.IGauge {
+	ret, err := c.TryRegistryGauge(name, help, constLabels, labels...)
+	var conflictErr *RegistryConflictError
+	if errors.As(err, &conflictErr) {
+		log.Fatal("Register the metrics Gauge repeatedly", zap.String("name", name), zap.String("help", help), zap.Error(err))
+	}
+	if err != nil {
+		log.Warn("Register the metrics Gauge fail.", zap.String("name", name), zap.String("help", help), zap.Error(err))
+		return zapp_metrics.DefNoopClient.Gauge(name)
+	}
+	return ret
+}
+func (c *clientCli) TryRegistryGauge(name, help string, constLabels zapp_metrics.Labels, labels ...string) (zapp_metrics.IGauge, error) {
 	c.gaugeCollectorLocker.Lock()
 	defer c.gaugeCollectorLocker.Unlock()
 
-	if _, ok := c.gaugeCollector[name]; ok {
-		log.Fatal("Register the metrics Gauge repeatedly", zap.String("name", name), zap.String("help", help))
+	err := c.claimMetricName(name, newMetricSignature(metricTypeGauge, help, nil, constLabels, labels))
+	if err != nil {
+		return nil, err
+	}
+	if ret, ok := c.gaugeCollector[name]; ok {
+		return ret, nil
 	}
 
 	gauge, err := c.meter.Float64Gauge(name, metric.WithDescription(help))
-	var ret zapp_metrics.IGauge
-	if err != nil {
-		log.Warn("Register the metrics Gauge fail.", zap.String("name", name), zap.String("help", help), zap.Error(err))
-		ret = zapp_metrics.DefNoopClient.Gauge(name)
-	} else {
-		ret = &gaugeCli{
-			name:       name,
-			v:          atomic.NewFloat64(0),
-			constLabel: genLabels(constLabels),
-			gauge:      gauge,
-		}
+	if err != nil { // 缓存空实现, 重复注册时不再重试和输出日志
+		noop := zapp_metrics.DefNoopClient.Gauge(name)
+		c.gaugeCollector[name] = noop
+		return noop, err
+	}
+	ret := &gaugeCli{
+		name:       name,
+		v:          atomic.NewFloat64(0),
+		constLabel: genLabels(constLabels),
+		gauge:      gauge,
 	}
-
 	c.gaugeCollector[name] = ret
-	return ret
+	return ret, nil
 }
 func (c *clientCli) Gauge(name string) zapp_metrics.IGauge {
 	c.gaugeCollectorLocker.RLock()
@@ -108,28 +140,42 @@ func (c *clientCli) Gauge(name string) zapp_metrics.IGauge {
 }
 
 func (c *clientCli) RegistryHistogram(name, help string, buckets []float64, constLabels zapp_metrics.Labels, labels ...string) zapp_metrics.IHistogram {
+	ret, err := c.TryRegistryHistogram(name, help, buckets, constLabels, labels...)
+	var conflictErr *RegistryConflictError
+	if errors.As(err, &conflictErr) {
+		log.Fatal("Register the metrics Histogram repeatedly", zap.String("name", name), zap.String("help", help), zap.Error(err))
+	}
+	if err != nil {
+		log.Warn("Register the metrics Histogram fail.", zap.String("name", name), zap.String("help", help), zap.Error(err))
+		return zapp_metrics.DefNoopClient.Histogram(name)
+	}
+	return ret
+}
+func (c *clientCli) TryRegistryHistogram(name, help string, buckets []float64, constLabels zapp_metrics.Labels, labels ...string) (zapp_metrics.IHistogram, error) {
 	c.histogramCollectorLocker.Lock()
 	defer c.histogramCollectorLocker.Unlock()
 
-	if _, ok := c.histogramCollector[name]; ok {
-		log.Fatal("Register the metrics Histogram repeatedly", zap.String("name", name), zap.String("help", help))
+	err := c.claimMetricName(name, newMetricSignature(metricTypeHistogram, help, buckets, constLabels, labels))
+	if err != nil {
+		return nil, err
+	}
+	if ret, ok := c.histogramCollector[name]; ok {
+		return ret, nil
 	}
 
 	histogram, err := c.meter.Float64Histogram(name, metric.WithDescription(help), metric.WithExplicitBucketBoundaries(buckets...))
-	var ret zapp_metrics.IHistogram
-	if err != nil {
-		log.Warn("Register the metrics Histogram fail.", zap.String("name", name), zap.String("help", help), zap.Error(err))
-		ret = zapp_metrics.DefNoopClient.Histogram(name)
-	} else {
-		ret = &histogramCli{
-			name:       name,
-			constLabel: genLabels(constLabels),
-			histogram:  histogram,
-		}
+	if err != nil { // 缓存空实现, 重复注册时不再重试和输出日志
+		noop := zapp_metrics.DefNoopClient.Histogram(name)
+		c.histogramCollector[name] = noop
+		return noop, err
+	}
+	ret := &histogramCli{
+		name:       name,
+		constLabel: genLabels(constLabels),
+		histogram:  histogram,
 	}
-
 	c.histogramCollector[name] = ret
-	return ret
+	return ret, nil
 }
 func (c *clientCli) Histogram(name string) zapp_metrics.IHistogram {
 	c.histogramCollectorLocker.RLock()
@@ -148,6 +194,10 @@ func (c *clientCli) RegistrySummary(name, help string, constLabels zapp_metrics.
 	summary := zapp_metrics.DefNoopClient.Summary(name)
 	return summary
 }
+func (c *clientCli) TryRegistrySummary(name, help string, constLabels zapp_metrics.Labels, labels ...string) (zapp_metrics.ISummary, error) {
+	return zapp_metrics.DefNoopClient.Summary(name), ErrSummaryNotSupported
+}
+
 func (c *clientCli) Summary(name string) zapp_metrics.ISummary {
 	log.Warn("Get metrics Summary fail. is nonsupport.", zap.String("name", name))
 	return zapp_metrics.DefNoopClient.Histogram(name)
@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/zly-app/zapp/component/metrics"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// 支持 context 的计数器, ctx 中有采样的 span 时由 sdk 自动作为 Exemplar 记录
+//
+// 注册的 Counter 实现了这个接口. ctx 中只有 OpenTracing 的 span 时转换为 OpenTelemetry 的 SpanContext 后记录.
+type CounterCtx interface {
+	IncCtx(ctx context.Context, labels metrics.Labels)
+	AddCtx(ctx context.Context, v float64, labels metrics.Labels)
+}
+
+// 支持 context 的观测器, ctx 中有采样的 span 时由 sdk 自动作为 Exemplar 记录
+//
+// 注册的 Histogram 实现了这个接口. ctx 中只有 OpenTracing 的 span 时转换为 OpenTelemetry 的 SpanContext 后记录.
+type ObserverCtx interface {
+	ObserveCtx(ctx context.Context, v float64, labels metrics.Labels)
+}
+
+func (c *counterCli) IncCtx(ctx context.Context, labels metrics.Labels) {
+	c.counter.Add(withOpenTracingSpan(ctx), 1, c.constLabel, genLabels(labels))
+}
+
+func (c *counterCli) AddCtx(ctx context.Context, v float64, labels metrics.Labels) {
+	c.counter.Add(withOpenTracingSpan(ctx), v, c.constLabel, genLabels(labels))
+}
+
+func (h *histogramCli) ObserveCtx(ctx context.Context, v float64, labels metrics.Labels) {
+	h.histogram.Record(withOpenTracingSpan(ctx), v, h.constLabel, genLabels(labels))
+}
+
+// ctx 中没有 OpenTelemetry 的 span 时, 将 OpenTracing 的 span 转换为 SpanContext 放入 ctx, sdk 才能作为 Exemplar 记录
+//
+// OpenTracing 的 SpanContext 由实现决定, 通过注入到 TextMap 中解析 W3C traceparent 或 jaeger uber-trace-id.
+func withOpenTracingSpan(ctx context.Context) context.Context {
+	if ctx == nil || trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx
+	}
+	span := opentracing.SpanFromContext(ctx)
+	if span == nil {
+		return ctx
+	}
+	carrier := opentracing.TextMapCarrier{}
+	if err := span.Tracer().Inject(span.Context(), opentracing.TextMap, carrier); err != nil {
+		return ctx
+	}
+	for k, v := range carrier {
+		var parts []string
+		var traceID, spanID, flags string
+		switch strings.ToLower(k) {
+		case "traceparent": // {version}-{trace-id}-{span-id}-{flags}
+			if parts = strings.Split(v, "-"); len(parts) != 4 {
+				return ctx
+			}
+			traceID, spanID, flags = parts[1], parts[2], parts[3]
+		case "uber-trace-id": // {trace-id}:{span-id}:{parent-span-id}:{flags}
+			if unescaped, err := url.QueryUnescape(v); err == nil {
+				v = unescaped
+			}
+			if parts = strings.Split(v, ":"); len(parts) != 4 {
+				return ctx
+			}
+			traceID, spanID, flags = parts[0], parts[1], parts[3]
+		default:
+			continue
+		}
+
+		sc, ok := parseSpanContext(traceID, spanID, flags)
+		if !ok {
+			return ctx
+		}
+		return trace.ContextWithSpanContext(ctx, sc)
+	}
+	return ctx
+}
+
+// 解析十六进制的 trace id, span id 和 flags, jaeger 的 id 可能省略前导 0
+func parseSpanContext(traceID, spanID, flags string) (trace.SpanContext, bool) {
+	if len(traceID) > 32 || len(spanID) > 16 {
+		return trace.SpanContext{}, false
+	}
+	tid, err := trace.TraceIDFromHex(strings.Repeat("0", 32-len(traceID)) + traceID)
+	if err != nil {
+		return trace.SpanContext{}, false
+	}
+	sid, err := trace.SpanIDFromHex(strings.Repeat("0", 16-len(spanID)) + spanID)
+	if err != nil {
+		return trace.SpanContext{}, false
+	}
+	f, err := strconv.ParseUint(flags, 16, 8)
+	if err != nil {
+		return trace.SpanContext{}, false
+	}
+	return trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    tid,
+		SpanID:     sid,
+		TraceFlags: trace.TraceFlags(f) & trace.FlagsSampled,
+		Remote:     true,
+	}), true
+}
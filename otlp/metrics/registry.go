@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	zapp_metrics "github.com/zly-app/zapp/component/metrics"
+)
+
+const (
+	metricTypeCounter   = "Counter"
+	metricTypeGauge     = "Gauge"
+	metricTypeHistogram = "Histogram"
+)
+
+// otlp 不支持 Summary 汇总
+var ErrSummaryNotSupported = errors.New("metrics Summary is not supported by otlp")
+
+// 非致命的指标注册, 重复注册签名一致的指标时返回已注册的指标, 签名不一致时返回 *RegistryConflictError
+//
+// sdk 创建指标失败时返回空实现和错误, 空实现会按签名缓存, 之后重复注册直接返回空实现.
+type TryRegistryClient interface {
+	TryRegistryCounter(name, help string, constLabels zapp_metrics.Labels, labels ...string) (zapp_metrics.ICounter, error)
+	TryRegistryGauge(name, help string, constLabels zapp_metrics.Labels, labels ...string) (zapp_metrics.IGauge, error)
+	TryRegistryHistogram(name, help string, buckets []float64, constLabels zapp_metrics.Labels, labels ...string) (zapp_metrics.IHistogram, error)
+	TryRegistrySummary(name, help string, constLabels zapp_metrics.Labels, labels ...string) (zapp_metrics.ISummary, error)
+}
+
+// 指标注册冲突, 同名指标已注册且签名(类型, 描述, 标签, 分桶)不一致
+type RegistryConflictError struct {
+	Name         string // 指标名
+	Type         string // 注册的指标类型
+	ExistingType string // 已注册的指标类型
+	Reason       string // 冲突原因
+}
+
+func (e *RegistryConflictError) Error() string {
+	return fmt.Sprintf("metrics %s %q conflicts with registered %s: %s", e.Type, e.Name, e.ExistingType, e.Reason)
+}
+
+// 指标签名
+type metricSignature struct {
+	typ         string
+	help        string
+	constLabels zapp_metrics.Labels
+	labels      []string
+	buckets     []float64
+}
+
+func newMetricSignature(typ, help string, buckets []float64, constLabels zapp_metrics.Labels, labels []string) *metricSignature {
+	sortedLabels := append([]string(nil), labels...)
+	sort.Strings(sortedLabels)
+	return &metricSignature{
+		typ:         typ,
+		help:        help,
+		constLabels: constLabels,
+		labels:      sortedLabels,
+		buckets:     append([]float64(nil), buckets...),
+	}
+}
+
+func (s *metricSignature) check(name string, o *metricSignature) error {
+	reason := ""
+	switch {
+	case s.typ != o.typ:
+		reason = "type differs"
+	case s.help != o.help:
+		reason = fmt.Sprintf("help differs: %q != %q", o.help, s.help)
+	case !equalLabels(s.constLabels, o.constLabels):
+		reason = fmt.Sprintf("const labels differ: %v != %v", o.constLabels, s.constLabels)
+	case strings.Join(s.labels, ",") != strings.Join(o.labels, ","):
+		reason = fmt.Sprintf("labels differ: %v != %v", o.labels, s.labels)
+	case !equalBuckets(s.buckets, o.buckets):
+		reason = fmt.Sprintf("buckets differ: %v != %v", o.buckets, s.buckets)
+	default:
+		return nil
+	}
+	return &RegistryConflictError{Name: name, Type: o.typ, ExistingType: s.typ, Reason: reason}
+}
+
+func equalLabels(a, b zapp_metrics.Labels) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+func equalBuckets(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// 占用指标名, 不同类型的指标不能同名
+func (c *clientCli) claimMetricName(name string, sign *metricSignature) error {
+	c.signaturesLocker.Lock()
+	defer c.signaturesLocker.Unlock()
+
+	if s, ok := c.signatures[name]; ok {
+		return s.check(name, sign)
+	}
+	c.signatures[name] = sign
+	return nil
+}
@@ -0,0 +1,103 @@
+package prometheus
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/zly-app/zapp/core"
+	"github.com/zly-app/zapp/pkg/utils"
+)
+
+// 构建信息收集器, 包括 zapp_build_info 和 zapp_start_time_seconds
+//
+// zapp_build_info 的值总是为 1, 标签包括 app, env, instance, version, goversion, revision, vcs_time, modified, flags 以及 Frame.Labels.
+// Frame.Labels 的标签名不合法的字符会替换为 _, 与固定的标签重名时忽略, 以 __ 开头的保留标签名会忽略并输出警告.
+func newBuildInfoCollectors(app core.IApp) []prometheus.Collector {
+	frame := app.GetConfig().Config().Frame
+
+	labels := prometheus.Labels(sanitizeFrameLabels(app, "zapp_build_info"))
+
+	instance := frame.Instance
+	if instance == "" {
+		instance = utils.GetInstance("")
+	}
+	flags := append([]string(nil), frame.Flags...)
+	sort.Strings(flags)
+
+	labels["app"] = app.Name()
+	labels["env"] = frame.Env
+	labels["instance"] = instance
+	labels["flags"] = strings.Join(flags, ",")
+	labels["goversion"] = runtime.Version()
+	labels["version"] = ""
+	labels["revision"] = ""
+	labels["vcs_time"] = ""
+	labels["modified"] = ""
+	if info, ok := debug.ReadBuildInfo(); ok {
+		labels["version"] = info.Main.Version
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				labels["revision"] = s.Value
+			case "vcs.time":
+				labels["vcs_time"] = s.Value
+			case "vcs.modified":
+				labels["modified"] = s.Value
+			}
+		}
+	}
+
+	buildInfo := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        "zapp_build_info",
+		Help:        "zapp 应用的构建信息, 值总是为 1",
+		ConstLabels: labels,
+	})
+	buildInfo.Set(1)
+
+	startTime := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        "zapp_start_time_seconds",
+		Help:        "zapp 应用的启动时间戳, 单位秒",
+		ConstLabels: prometheus.Labels{"app": app.Name(), "env": frame.Env, "instance": instance},
+	})
+	startTime.Set(float64(processStartTime.UnixMilli()) / 1e3)
+	return []prometheus.Collector{buildInfo, startTime}
+}
+
+// 进程启动时间, 以包初始化时间为准
+var processStartTime = time.Now()
+
+// 可以作为标签的 Frame.Labels, 标签名不合法的字符会替换为 _, 以 __ 开头的保留标签名会忽略并输出警告, use 为日志中的用途
+func sanitizeFrameLabels(app core.IApp, use string) map[string]string {
+	labels := make(map[string]string)
+	for k, v := range app.GetConfig().Config().Frame.Labels {
+		if k == "" {
+			continue
+		}
+		name := sanitizeLabelName(k)
+		if strings.HasPrefix(name, "__") {
+			app.Warn("metrics "+use+" 忽略保留的标签名", zap.String("label", k))
+			continue
+		}
+		labels[name] = v
+	}
+	return labels
+}
+
+// 将不合法的标签名字符替换为 _
+func sanitizeLabelName(name string) string {
+	var sb strings.Builder
+	for i, r := range name {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (i > 0 && r >= '0' && r <= '9') {
+			sb.WriteRune(r)
+			continue
+		}
+		sb.WriteByte('_')
+	}
+	return sb.String()
+}
@@ -0,0 +1,236 @@
+package prometheus
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultCgroupRoot = "/sys/fs/cgroup"
+
+// 容器收集器, 读取当前进程所在 cgroup(v1 或 v2) 的 CPU 配额, 限流, 内存限制和使用量
+//
+// 每次收集时读取 cgroup 文件, 读取失败的指标不会导出, 非 linux 系统不会导出任何指标.
+// 未设置 CPU 配额或内存限制时不导出 zapp_container_cpu_quota_cores 和 zapp_container_memory_limit_bytes.
+type cgroupCollector struct {
+	root   string // cgroup 挂载点
+	selfCg string // 当前进程的 cgroup 文件, 一般为 /proc/self/cgroup
+
+	quota            *prometheus.Desc
+	usage            *prometheus.Desc
+	periods          *prometheus.Desc
+	throttledPeriods *prometheus.Desc
+	throttledSeconds *prometheus.Desc
+	memLimit         *prometheus.Desc
+	memUsage         *prometheus.Desc
+	memWorkingSet    *prometheus.Desc
+	oomKills         *prometheus.Desc
+}
+
+func newCgroupCollector() *cgroupCollector {
+	return &cgroupCollector{
+		root:   defaultCgroupRoot,
+		selfCg: "/proc/self/cgroup",
+		quota: prometheus.NewDesc("zapp_container_cpu_quota_cores",
+			"容器的 CPU 配额, 单位核", nil, nil),
+		usage: prometheus.NewDesc("zapp_container_cpu_usage_seconds_total",
+			"容器使用的 CPU 时间, 单位秒", nil, nil),
+		periods: prometheus.NewDesc("zapp_container_cpu_periods_total",
+			"容器经过的 CPU 调度周期数", nil, nil),
+		throttledPeriods: prometheus.NewDesc("zapp_container_cpu_throttled_periods_total",
+			"容器被限流的 CPU 调度周期数", nil, nil),
+		throttledSeconds: prometheus.NewDesc("zapp_container_cpu_throttled_seconds_total",
+			"容器被限流的时间, 单位秒", nil, nil),
+		memLimit: prometheus.NewDesc("zapp_container_memory_limit_bytes",
+			"容器的内存限制, 单位字节", nil, nil),
+		memUsage: prometheus.NewDesc("zapp_container_memory_usage_bytes",
+			"容器的内存使用量, 包括文件缓存, 单位字节", nil, nil),
+		memWorkingSet: prometheus.NewDesc("zapp_container_memory_working_set_bytes",
+			"容器的工作集内存, 为使用量减去非活跃文件缓存, 超出内存限制时会被 OOM, 单位字节", nil, nil),
+		oomKills: prometheus.NewDesc("zapp_container_memory_oom_kills_total",
+			"容器内被 OOM 杀死的进程数", nil, nil),
+	}
+}
+
+func (c *cgroupCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.quota
+	ch <- c.usage
+	ch <- c.periods
+	ch <- c.throttledPeriods
+	ch <- c.throttledSeconds
+	ch <- c.memLimit
+	ch <- c.memUsage
+	ch <- c.memWorkingSet
+	ch <- c.oomKills
+}
+
+func (c *cgroupCollector) Collect(ch chan<- prometheus.Metric) {
+	if _, err := os.Stat(filepath.Join(c.root, "cgroup.controllers")); err == nil {
+		c.collectV2(ch)
+		return
+	}
+	c.collectV1(ch)
+}
+
+func (c *cgroupCollector) collectV2(ch chan<- prometheus.Metric) {
+	dir := c.dir("")
+
+	// cpu.max 格式为 "$MAX $PERIOD", 未限制时 $MAX 为 max
+	if fields := strings.Fields(readCgroupString(filepath.Join(dir, "cpu.max"))); len(fields) == 2 && fields[0] != "max" {
+		quota, err1 := strconv.ParseFloat(fields[0], 64)
+		period, err2 := strconv.ParseFloat(fields[1], 64)
+		if err1 == nil && err2 == nil && period > 0 {
+			ch <- prometheus.MustNewConstMetric(c.quota, prometheus.GaugeValue, quota/period)
+		}
+	}
+	stat := readCgroupKV(filepath.Join(dir, "cpu.stat"))
+	if v, ok := stat["usage_usec"]; ok {
+		ch <- prometheus.MustNewConstMetric(c.usage, prometheus.CounterValue, v/1e6)
+	}
+	if v, ok := stat["nr_periods"]; ok {
+		ch <- prometheus.MustNewConstMetric(c.periods, prometheus.CounterValue, v)
+	}
+	if v, ok := stat["nr_throttled"]; ok {
+		ch <- prometheus.MustNewConstMetric(c.throttledPeriods, prometheus.CounterValue, v)
+	}
+	if v, ok := stat["throttled_usec"]; ok {
+		ch <- prometheus.MustNewConstMetric(c.throttledSeconds, prometheus.CounterValue, v/1e6)
+	}
+
+	if v, ok := readCgroupFloat(filepath.Join(dir, "memory.max")); ok {
+		ch <- prometheus.MustNewConstMetric(c.memLimit, prometheus.GaugeValue, v)
+	}
+	if usage, ok := readCgroupFloat(filepath.Join(dir, "memory.current")); ok {
+		ch <- prometheus.MustNewConstMetric(c.memUsage, prometheus.GaugeValue, usage)
+		memStat := readCgroupKV(filepath.Join(dir, "memory.stat"))
+		ch <- prometheus.MustNewConstMetric(c.memWorkingSet, prometheus.GaugeValue, workingSet(usage, memStat["inactive_file"]))
+	}
+	if v, ok := readCgroupKV(filepath.Join(dir, "memory.events"))["oom_kill"]; ok {
+		ch <- prometheus.MustNewConstMetric(c.oomKills, prometheus.CounterValue, v)
+	}
+}
+
+func (c *cgroupCollector) collectV1(ch chan<- prometheus.Metric) {
+	cpuDir := c.dir("cpu")
+	quota, ok1 := readCgroupFloat(filepath.Join(cpuDir, "cpu.cfs_quota_us"))
+	period, ok2 := readCgroupFloat(filepath.Join(cpuDir, "cpu.cfs_period_us"))
+	if ok1 && ok2 && quota > 0 && period > 0 { // 未限制时 quota 为 -1
+		ch <- prometheus.MustNewConstMetric(c.quota, prometheus.GaugeValue, quota/period)
+	}
+	stat := readCgroupKV(filepath.Join(cpuDir, "cpu.stat"))
+	if v, ok := stat["nr_periods"]; ok {
+		ch <- prometheus.MustNewConstMetric(c.periods, prometheus.CounterValue, v)
+	}
+	if v, ok := stat["nr_throttled"]; ok {
+		ch <- prometheus.MustNewConstMetric(c.throttledPeriods, prometheus.CounterValue, v)
+	}
+	if v, ok := stat["throttled_time"]; ok {
+		ch <- prometheus.MustNewConstMetric(c.throttledSeconds, prometheus.CounterValue, v/1e9)
+	}
+	if v, ok := readCgroupFloat(filepath.Join(c.dir("cpuacct"), "cpuacct.usage")); ok {
+		ch <- prometheus.MustNewConstMetric(c.usage, prometheus.CounterValue, v/1e9)
+	}
+
+	memDir := c.dir("memory")
+	if v, ok := readCgroupFloat(filepath.Join(memDir, "memory.limit_in_bytes")); ok && v < 1<<62 { // 未限制时为一个接近 int64 上限的值
+		ch <- prometheus.MustNewConstMetric(c.memLimit, prometheus.GaugeValue, v)
+	}
+	if usage, ok := readCgroupFloat(filepath.Join(memDir, "memory.usage_in_bytes")); ok {
+		ch <- prometheus.MustNewConstMetric(c.memUsage, prometheus.GaugeValue, usage)
+		memStat := readCgroupKV(filepath.Join(memDir, "memory.stat"))
+		ch <- prometheus.MustNewConstMetric(c.memWorkingSet, prometheus.GaugeValue, workingSet(usage, memStat["total_inactive_file"]))
+	}
+	if v, ok := readCgroupKV(filepath.Join(memDir, "memory.oom_control"))["oom_kill"]; ok {
+		ch <- prometheus.MustNewConstMetric(c.oomKills, prometheus.CounterValue, v)
+	}
+}
+
+// 当前进程所在 cgroup 的目录, controller 为空表示 v2
+//
+// 没有 cgroup 命名空间时 /proc/self/cgroup 中是宿主机上的路径, 而容器内挂载的是自身的 cgroup, 此时使用挂载点.
+func (c *cgroupCollector) dir(controller string) string {
+	base := c.root
+	path := ""
+	data, _ := os.ReadFile(c.selfCg)
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.SplitN(line, ":", 3) // 格式为 hierarchy-ID:controller-list:cgroup-path
+		if len(parts) != 3 {
+			continue
+		}
+		if controller == "" {
+			if parts[0] == "0" && parts[1] == "" {
+				path = parts[2]
+				break
+			}
+			continue
+		}
+		for _, name := range strings.Split(parts[1], ",") {
+			if name == controller {
+				base = filepath.Join(c.root, parts[1])
+				path = parts[2]
+				break
+			}
+		}
+		if path != "" {
+			break
+		}
+	}
+	if controller != "" && base == c.root {
+		base = filepath.Join(c.root, controller)
+	}
+
+	dir := filepath.Join(base, path)
+	if _, err := os.Stat(dir); err != nil {
+		return base
+	}
+	return dir
+}
+
+func workingSet(usage, inactiveFile float64) float64 {
+	if inactiveFile > usage {
+		return 0
+	}
+	return usage - inactiveFile
+}
+
+func readCgroupString(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// 读取只有一个数值的文件, 值为 max 时返回 false
+func readCgroupFloat(path string) (float64, bool) {
+	v, err := strconv.ParseFloat(readCgroupString(path), 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+// 读取每行为 "key value" 格式的文件
+func readCgroupKV(path string) map[string]float64 {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	ret := make(map[string]float64)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if v, err := strconv.ParseFloat(fields[1], 64); err == nil {
+			ret[fields[0]] = v
+		}
+	}
+	return ret
+}
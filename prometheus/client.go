@@ -2,26 +2,32 @@ package prometheus
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net"
 	"net/http"
-	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/client_golang/prometheus/push"
-	"github.com/prometheus/common/expfmt"
+	io_prometheus_client "github.com/prometheus/client_model/go"
 	"github.com/zlyuancn/zretry"
 	"go.uber.org/zap"
 
 	"github.com/zly-app/zapp/component/metrics"
 	"github.com/zly-app/zapp/core"
-	"github.com/zly-app/zapp/handler"
 	"github.com/zly-app/zapp/log"
 )
 
+const (
+	PushMethodPush = "push" // 使用 PUT 推送, 替换分组中的所有指标
+	PushMethodAdd  = "add"  // 使用 POST 推送, 只替换同名的指标
+)
+
 type Client struct {
 	app  core.IApp
 	conf *Config
@@ -38,19 +44,77 @@ type Client struct {
 	summaryCollector       map[string]metrics.ISummary // 汇总
 	summaryCollectorLocker sync.RWMutex
 
-	pullRegistry *prometheus.Registry // pull模式注册器
-	pusher       *push.Pusher         // push模式推送器
-	remoteWrite  *RemoteWrite
+	signatures       map[string]*metricSignature // 已注册的指标签名
+	signaturesLocker sync.Mutex
+
+	series         []*series // 所有指标的时间序列, 用于检查过期
+	seriesLocker   sync.RWMutex
+	rejectedSeries *prometheus.CounterVec // 超出时间序列数量限制被拒绝的观测次数
+	selfMetrics    *selfMetrics           // 发送器自身的指标
+
+	registry    *prometheus.Registry    // 注册器, pull模式, push模式和 RemoteWrite 模式共用
+	gatherers   *gathererList           // 收集器列表, 包含 registry 和通过 AddGatherer 添加的收集器
+	pullHandler *reloadableGuardHandler // pull模式 metrics handler
+	exporters   *exporters              // push模式, RemoteWrite 模式, StatsD 模式和 InfluxDB 模式的发送器
+	exportersMx sync.Mutex
+
+	server *http.Server // pull模式服务
+
+	ctx       context.Context // 关闭时取消
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup // 等待推送和写入循环退出
+	closeOnce sync.Once
+	ready     atomic.Bool // 是否已启动完成
 }
 
 func (p *Client) Inject(a ...interface{}) {}
 func (p *Client) Start() error {
-	p.startPullMode(p.conf)
-	p.startPushMode(p.conf)
-	p.startRemoteWrite(p.conf)
+	err := p.startPullMode(p.conf)
+	if err != nil {
+		return err
+	}
+	e, err := p.newExporters(p.conf)
+	if err != nil {
+		return err
+	}
+	p.exportersMx.Lock()
+	p.exporters = e
+	p.startExporters(e)
+	p.exportersMx.Unlock()
+	p.startSeriesExpire(p.conf)
+	p.ready.Store(true)
+	p.startWatchConfig(p.conf)
 	return nil
 }
-func (p *Client) Close() error { return nil }
+
+// 关闭, 停止推送和写入, 关闭pull模式服务, 并在 CloseTimeout 内完成最后一次推送和写入
+func (p *Client) Close() error {
+	var errs []error
+	p.closeOnce.Do(func() {
+		// 等待进行中的热更新完成, 之后的热更新不再生效
+		p.exportersMx.Lock()
+		p.ready.Store(false)
+		p.exportersMx.Unlock()
+		p.cancel()
+		p.wg.Wait()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(p.conf.CloseTimeout)*time.Millisecond)
+		defer cancel()
+
+		if p.server != nil {
+			if err := p.server.Shutdown(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("metrics pull server shutdown err: %v", err))
+			}
+		}
+		p.exportersMx.Lock()
+		if p.exporters != nil {
+			errs = append(errs, p.stopExporters(ctx, p.exporters, true)...)
+			p.exporters = nil
+		}
+		p.exportersMx.Unlock()
+	})
+	return errors.Join(errs...)
+}
 
 func NewClient(app core.IApp, conf *Config) *Client {
 	conf.Check()
@@ -62,217 +126,318 @@ func NewClient(app core.IApp, conf *Config) *Client {
 		gaugeCollector:     make(map[string]metrics.IGauge),
 		histogramCollector: make(map[string]metrics.IHistogram),
 		summaryCollector:   make(map[string]metrics.ISummary),
+		signatures:         make(map[string]*metricSignature),
 	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
 
-	if conf.PullBind != "" {
-		p.pullRegistry = prometheus.NewRegistry()
-	}
-	if conf.PushAddress != "" {
-		p.pusher = push.New(conf.PushAddress, p.app.Name())
-	}
-	if conf.WriteAddress != "" {
-		p.remoteWrite = NewRemoteWrite(conf.WriteAddress)
+	p.registry = prometheus.NewRegistry()
+	p.gatherers = &gathererList{list: prometheus.Gatherers{p.registry}}
+	guard, err := newPullGuard(conf)
+	if err != nil {
+		log.Fatal("metrics pull模式访问控制配置错误", zap.Error(err))
 	}
+	p.pullHandler = newReloadableGuardHandler(guard, promhttp.InstrumentMetricHandler(p.registry,
+		promhttp.HandlerFor(p.gatherers, promhttp.HandlerOpts{EnableOpenMetrics: conf.EnableOpenMetrics})))
 
-	coll := []prometheus.Collector{}
+	p.selfMetrics = newSelfMetrics()
+
+	p.rejectedSeries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "metrics_rejected_observations_total",
+		Help: "超出时间序列数量限制被拒绝的观测次数, 同一个时间序列的每次观测都会计数",
+	}, []string{"name", "action"})
+	coll := []prometheus.Collector{p.rejectedSeries}
+	coll = append(coll, p.selfMetrics.collectors()...)
 	if p.conf.ProcessCollector {
 		coll = append(coll, collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
 	}
 	if p.conf.GoCollector {
-		coll = append(coll, collectors.NewGoCollector())
+		goCollector, err := newGoCollector(p.conf)
+		if err != nil {
+			log.Fatal("metrics go收集器配置错误", zap.Error(err))
+		}
+		coll = append(coll, goCollector)
 	}
-	err := p.registryCollector(coll...)
+	if p.conf.ContainerCollector {
+		coll = append(coll, newCgroupCollector())
+	}
+	if p.conf.BuildInfo {
+		coll = append(coll, newBuildInfoCollectors(app)...)
+	}
+	err = p.registryCollector(coll...)
 	if err != nil {
 		log.Fatal("注册默认收集器失败", zap.Error(err))
 	}
+	err = p.registryDeclaredMetrics(conf.Metrics)
+	if err != nil {
+		log.Fatal("注册配置中声明的 metrics 失败", zap.Error(err))
+	}
 	return p
 }
 
 // 启动pull模式
-func (p *Client) startPullMode(conf *Config) {
-	if p.pullRegistry == nil {
-		return
+func (p *Client) startPullMode(conf *Config) error {
+	if conf.PullService != "" {
+		err := p.mountPullHandler(conf)
+		if err != nil {
+			return err
+		}
+		p.app.Info("启用 metrics pull模式", zap.String("PullService", conf.PullService), zap.String("PullPath", conf.PullPath),
+			zap.Strings("AllowCIDRs", conf.PullAllowCIDRs))
 	}
+	if conf.PullBind == "" {
+		return nil
+	}
+
+	p.app.Info("启用 metrics pull模式", zap.String("PullBind", conf.PullBind), zap.String("PullPath", conf.PullPath),
+		zap.Bool("TLS", conf.PullTLSCertFile != ""), zap.Strings("AllowCIDRs", conf.PullAllowCIDRs))
 
-	p.app.Info("启用 metrics pull模式", zap.String("PullBind", conf.PullBind), zap.String("PullPath", conf.PullPath))
+	tlsConfig, err := newPullTLSConfig(conf)
+	if err != nil {
+		return fmt.Errorf("metrics pull mode tls config err: %v", err)
+	}
 
 	// 构建server
-	handle := promhttp.InstrumentMetricHandler(p.pullRegistry, promhttp.HandlerFor(p.pullRegistry, promhttp.HandlerOpts{EnableOpenMetrics: conf.EnableOpenMetrics}))
 	mux := http.NewServeMux()
-	mux.Handle(conf.PullPath, handle)
-	server := &http.Server{Addr: conf.PullBind, Handler: mux}
+	p.registerPullHandlers(conf, mux)
+	server := &http.Server{Addr: conf.PullBind, Handler: mux, TLSConfig: tlsConfig}
 
-	handler.AddHandler(handler.AfterExitHandler, func(app core.IApp, handlerType handler.HandlerType) {
-		_ = server.Close()
-	})
 	// 开始监听
-	go func(server *http.Server) {
-		if err := server.ListenAndServe(); err != nil {
-			log.Log.Fatal("启动pull模式失败", zap.Error(err))
+	listener, err := net.Listen("tcp", conf.PullBind)
+	if err != nil {
+		return fmt.Errorf("metrics pull mode listen err: %v", err)
+	}
+	p.server = server
+	go func(server *http.Server, listener net.Listener) {
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			p.app.Error("metrics pull模式服务异常退出", zap.Error(err))
 		}
-	}(server)
+	}(server, listener)
+	return nil
 }
 
 // 启动push模式
-func (p *Client) startPushMode(conf *Config) {
-	if p.pusher == nil {
+func (p *Client) startPushMode(e *exporters) {
+	if e.pusher == nil {
 		return
 	}
 
-	if conf.EnableOpenMetrics {
-		p.pusher.Format(expfmt.NewFormat(expfmt.TypeOpenMetrics))
-	}
-	p.pusher.Grouping("app", p.app.Name())
-	p.pusher.Grouping("env", p.app.GetConfig().Config().Frame.Env)
-	p.pusher.Grouping("instance", conf.PushInstance)
+	conf := e.conf
+	p.app.Info("启用 metrics push 模式", zap.String("PushAddress", conf.PushAddress), zap.String("PushInstance", conf.PushInstance), zap.String("PushMethod", conf.PushMethod))
 
-	var defaultDialer = &net.Dialer{
-		Timeout:   30 * time.Second,
-		KeepAlive: 30 * time.Second,
-	}
-	p.pusher.Client(&http.Client{Transport: &http.Transport{
-		Proxy:                 http.ProxyFromEnvironment,
-		DialContext:           defaultDialer.DialContext,
-		ForceAttemptHTTP2:     true,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-	}})
-
-	p.app.Info("启用 metrics push 模式", zap.String("PushAddress", conf.PushAddress), zap.String("PushInstance", conf.PushInstance))
-
-	// 开始推送
-	done, cancel := context.WithCancel(context.Background())
-	handler.AddHandler(handler.AfterExitHandler, func(app core.IApp, handlerType handler.HandlerType) {
-		cancel()
-	})
+	// 开始推送, 最后一次推送由 Close 完成
+	e.wg.Add(1)
 	go func(ctx context.Context, conf *Config, pusher *push.Pusher) {
+		defer e.wg.Done()
 		for {
 			t := time.NewTimer(time.Duration(conf.PushTimeInterval) * time.Millisecond)
 			select {
 			case <-ctx.Done():
 				t.Stop()
-				p.push(conf, pusher) // 最后一次推送
 				return
 			case <-t.C:
-				p.push(conf, pusher)
+				p.push(ctx, conf, pusher)
 			}
 		}
-	}(done, conf, p.pusher)
+	}(e.ctx, conf, e.pusher)
 }
 
 // 启动RemoteWrite模式
-func (p *Client) startRemoteWrite(conf *Config) {
-	if p.remoteWrite == nil {
+func (p *Client) startRemoteWrite(e *exporters) {
+	if len(e.writeTargets) == 0 {
 		return
 	}
 
-	if conf.EnableOpenMetrics {
-		p.remoteWrite.FormatType(expfmt.TypeOpenMetrics)
+	for _, t := range e.writeTargets {
+		p.app.Info("启用 metrics RemoteWrite 模式", zap.String("target", t.conf.Name), zap.String("Url", t.conf.Address),
+			zap.String("ProtocolVersion", t.conf.ProtocolVersion), zap.Int("Shards", t.conf.Shards))
 	}
 
-	labels := make([]string, 0, len(p.app.GetConfig().Config().Frame.Labels))
-	for k, v := range p.app.GetConfig().Config().Frame.Labels {
-		labels = append(labels, k+"="+v)
+	// 开始写入, 最后一次写入由 Close 完成
+	for _, targets := range groupWriteTargets(e.writeTargets) {
+		e.wg.Add(1)
+		go func(ctx context.Context, targets []*writeTarget) {
+			defer e.wg.Done()
+			interval := time.Duration(targets[0].conf.TimeInterval) * time.Millisecond
+			for {
+				t := time.NewTimer(interval)
+				select {
+				case <-ctx.Done():
+					t.Stop()
+					return
+				case <-t.C:
+					_ = writeTargetsOnce(ctx, p.gatherers, targets)
+				}
+			}
+		}(e.ctx, targets)
 	}
-	sort.Strings(labels)
-	p.remoteWrite.ExtraLabel("app", p.app.Name())
-	p.remoteWrite.ExtraLabel("env", p.app.GetConfig().Config().Frame.Env)
-	p.remoteWrite.ExtraLabel("instance", conf.WriteInstance)
+}
 
-	var defaultDialer = &net.Dialer{
-		Timeout:   30 * time.Second,
-		KeepAlive: 30 * time.Second,
+// 启动 StatsD 模式
+func (p *Client) startStatsd(e *exporters) {
+	if e.statsd == nil {
+		return
 	}
-	p.remoteWrite.Client(&http.Client{Transport: &http.Transport{
-		Proxy:                 http.ProxyFromEnvironment,
-		DialContext:           defaultDialer.DialContext,
-		ForceAttemptHTTP2:     true,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-	}})
 
-	p.app.Info("启用 metrics RemoteWrite 模式", zap.String("Url", conf.WriteAddress))
+	conf := e.conf
+	p.app.Info("启用 metrics StatsD 模式", zap.String("StatsdAddress", conf.StatsdAddress), zap.String("StatsdFormat", conf.StatsdFormat))
 
-	// 开始写入
-	done, cancel := context.WithCancel(context.Background())
-	handler.AddHandler(handler.AfterExitHandler, func(app core.IApp, handlerType handler.HandlerType) {
-		cancel()
-	})
-	go func(ctx context.Context, conf *Config, write *RemoteWrite) {
+	// 开始发送, 最后一次发送由 Close 完成
+	e.wg.Add(1)
+	go func(ctx context.Context, conf *Config, sink *statsdSink) {
+		defer e.wg.Done()
 		for {
-			t := time.NewTimer(time.Duration(conf.WriteTimeInterval) * time.Millisecond)
+			t := time.NewTimer(time.Duration(conf.StatsdFlushInterval) * time.Millisecond)
 			select {
 			case <-ctx.Done():
 				t.Stop()
-				p.write(conf, write) // 最后一次推送
 				return
 			case <-t.C:
-				p.write(conf, write)
+				if err := sink.Flush(); err != nil {
+					p.app.Error("metrics StatsD 发送失败", zap.Error(err))
+				}
 			}
 		}
-	}(done, conf, p.remoteWrite)
+	}(e.ctx, conf, e.statsd)
 }
 
-// 推送
-func (p *Client) push(conf *Config, pusher *push.Pusher) {
-	zretry.DoRetry(int(conf.PushRetry+1), time.Duration(conf.PushRetryInterval)*time.Millisecond, pusher.Push,
-		func(nowAttemptCount, remainCount int, err error) {
-			p.app.Error("metrics push 失败", zap.Error(err))
-		},
-	)
-}
-
-// remote write
-func (p *Client) write(conf *Config, write *RemoteWrite) {
-	err := write.Collect()
-	if err != nil {
-		p.app.Error("metrics RemoteWrite Collect 失败", zap.Error(err))
+// 启动 InfluxDB 模式
+func (p *Client) startInflux(e *exporters) {
+	if e.influx == nil {
 		return
 	}
-	zretry.DoRetry(int(conf.WriteRetry+1), time.Duration(conf.WriteRetryInterval)*time.Millisecond,
+
+	conf := e.conf
+	p.app.Info("启用 metrics InfluxDB 模式", zap.String("InfluxAddress", conf.InfluxAddress), zap.String("InfluxBucket", conf.InfluxBucket))
+
+	// 开始写入, 最后一次写入由 Close 完成
+	e.wg.Add(1)
+	go func(ctx context.Context, conf *Config, sink *influxSink) {
+		defer e.wg.Done()
+		for {
+			t := time.NewTimer(time.Duration(conf.InfluxTimeInterval) * time.Millisecond)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return
+			case <-t.C:
+				if err := sink.Write(ctx); err != nil {
+					p.app.Error("metrics InfluxDB 写入失败", zap.Error(err))
+				}
+			}
+		}
+	}(e.ctx, conf, e.influx)
+}
+
+// 推送
+func (p *Client) push(ctx context.Context, conf *Config, pusher *push.Pusher) {
+	zretry.DoRetry(int(conf.PushRetry+1), time.Duration(conf.PushRetryInterval)*time.Millisecond,
 		func() error {
-			return write.PushLocal()
+			if ctx.Err() != nil { // 已关闭, 不再重试
+				return nil
+			}
+			return p.pushOnce(ctx, conf, pusher)
 		},
 		func(nowAttemptCount, remainCount int, err error) {
-			p.app.Error("metrics RemoteWrite 失败", zap.Error(err))
+			p.app.Error("metrics push 失败", zap.Error(err))
 		},
 	)
 }
 
-// 注册收集器
-func (p *Client) registryCollector(collector ...prometheus.Collector) error {
-	if p.pullRegistry != nil {
-		for _, coll := range collector {
-			err := p.pullRegistry.Register(coll)
-			if err != nil {
-				return err
-			}
-		}
+// 按 PushMethod 推送一次
+func (p *Client) pushOnce(ctx context.Context, conf *Config, pusher *push.Pusher) error {
+	if conf.PushMethod == PushMethodAdd {
+		return pusher.AddContext(ctx)
 	}
+	return pusher.PushContext(ctx)
+}
 
-	if p.pusher != nil {
-		for _, coll := range collector {
-			p.pusher.Collector(coll)
-		}
+// 从 pushGateway 删除本实例的分组
+//
+// Delete 不支持 ctx, 改用超时时间为关闭超时剩余时间的 http 客户端, 超时后请求会被取消.
+func (p *Client) deletePushGroup(ctx context.Context, e *exporters) error {
+	timeout := time.Duration(e.conf.CloseTimeout) * time.Millisecond
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	if timeout <= 0 {
+		return context.DeadlineExceeded
 	}
-	if p.remoteWrite != nil {
-		for _, coll := range collector {
-			p.remoteWrite.Collector(coll)
+	client := *e.pushClient
+	client.Timeout = timeout
+	e.pusher.Client(&selfMetricsDoer{client: &client, metrics: p.selfMetrics, exporter: exporterPush, target: e.pushJob})
+	return e.pusher.Delete()
+}
+
+// 注册收集器
+func (p *Client) registryCollector(collector ...prometheus.Collector) error {
+	for _, coll := range collector {
+		err := p.RegisterCollector(coll)
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+// 注册自定义收集器, 注册后会通过 pull模式, push模式和 RemoteWrite 模式导出
+func (p *Client) RegisterCollector(collector prometheus.Collector) error {
+	return p.registry.Register(collector)
+}
+
+// 注销通过 RegisterCollector 注册的收集器, 返回是否注销成功
+func (p *Client) UnregisterCollector(collector prometheus.Collector) bool {
+	return p.registry.Unregister(collector)
+}
+
+// 添加收集器, 如其它注册器, 添加后会通过 pull模式, push模式和 RemoteWrite 模式导出
+func (p *Client) AddGatherer(g prometheus.Gatherer) {
+	p.gatherers.Add(g)
+}
+
+// 可以动态添加的收集器列表
+type gathererList struct {
+	mx   sync.RWMutex
+	list prometheus.Gatherers
+}
+
+func (g *gathererList) Add(gatherer prometheus.Gatherer) {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	g.list = append(g.list, gatherer)
+}
+
+func (g *gathererList) Gather() ([]*io_prometheus_client.MetricFamily, error) {
+	g.mx.RLock()
+	list := append(prometheus.Gatherers(nil), g.list...)
+	g.mx.RUnlock()
+	return list.Gather()
+}
+
 func (p *Client) RegistryCounter(name, help string, constLabels metrics.Labels, labels ...string) metrics.ICounter {
+	c, err := p.TryRegistryCounter(name, help, constLabels, labels...)
+	if err != nil {
+		p.app.Fatal("注册 metrics Counter 计数器失败", zap.String("name", name), zap.Error(err))
+	}
+	return c
+}
+
+// 注册计数器, 重复注册签名一致的计数器时返回已注册的计数器, 签名不一致时返回 *RegistryConflictError
+func (p *Client) TryRegistryCounter(name, help string, constLabels metrics.Labels, labels ...string) (metrics.ICounter, error) {
 	p.counterCollectorLocker.Lock()
 	defer p.counterCollectorLocker.Unlock()
 
-	if _, ok := p.counterCollector[name]; ok {
-		p.app.Fatal("重复注册 metrics Counter 计数器", zap.String("name", name))
+	err := p.claimMetricName(name, newMetricSignature(metricTypeCounter, help, nil, constLabels, labels))
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := p.counterCollector[name]; ok {
+		return c, nil
 	}
 
 	counter := prometheus.NewCounterVec(prometheus.CounterOpts{
@@ -282,14 +447,16 @@ func (p *Client) RegistryCounter(name, help string, constLabels metrics.Labels,
 		Help:        help,
 		ConstLabels: constLabels,
 	}, labels)
-	err := p.registryCollector(counter)
+	err = p.registryCollector(counter)
 	if err != nil {
-		p.app.Fatal("注册 metrics Counter 计数器失败", zap.Error(err))
+		p.releaseMetricName(name)
+		return nil, fmt.Errorf("registry metrics Counter %q err: %w", name, err)
 	}
 
-	c := &counterCli{name, counter}
+	c := &counterCli{series: newSeries(name, counter.MetricVec), name: name, counter: counter}
+	p.addSeries(c.series)
 	p.counterCollector[name] = c
-	return c
+	return c, nil
 }
 func (p *Client) Counter(name string) metrics.ICounter {
 	p.counterCollectorLocker.RLock()
@@ -304,11 +471,24 @@ func (p *Client) Counter(name string) metrics.ICounter {
 }
 
 func (p *Client) RegistryGauge(name, help string, constLabels metrics.Labels, labels ...string) metrics.IGauge {
+	g, err := p.TryRegistryGauge(name, help, constLabels, labels...)
+	if err != nil {
+		p.app.Fatal("注册 metrics Gauge 计量器失败", zap.String("name", name), zap.Error(err))
+	}
+	return g
+}
+
+// 注册计量器, 重复注册签名一致的计量器时返回已注册的计量器, 签名不一致时返回 *RegistryConflictError
+func (p *Client) TryRegistryGauge(name, help string, constLabels metrics.Labels, labels ...string) (metrics.IGauge, error) {
 	p.gaugeCollectorLocker.Lock()
 	defer p.gaugeCollectorLocker.Unlock()
 
-	if _, ok := p.gaugeCollector[name]; ok {
-		p.app.Fatal("重复注册 metrics Gauge 计量器")
+	err := p.claimMetricName(name, newMetricSignature(metricTypeGauge, help, nil, constLabels, labels))
+	if err != nil {
+		return nil, err
+	}
+	if g, ok := p.gaugeCollector[name]; ok {
+		return g, nil
 	}
 
 	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
@@ -318,14 +498,16 @@ func (p *Client) RegistryGauge(name, help string, constLabels metrics.Labels, la
 		Help:        help,
 		ConstLabels: constLabels,
 	}, labels)
-	err := p.registryCollector(gauge)
+	err = p.registryCollector(gauge)
 	if err != nil {
-		p.app.Fatal("注册 metrics Gauge 计量器失败", zap.Error(err))
+		p.releaseMetricName(name)
+		return nil, fmt.Errorf("registry metrics Gauge %q err: %w", name, err)
 	}
 
-	g := &gaugeCli{name, gauge}
+	g := &gaugeCli{series: newSeries(name, gauge.MetricVec), name: name, gauge: gauge}
+	p.addSeries(g.series)
 	p.gaugeCollector[name] = g
-	return g
+	return g, nil
 }
 func (p *Client) Gauge(name string) metrics.IGauge {
 	p.gaugeCollectorLocker.RLock()
@@ -340,30 +522,21 @@ func (p *Client) Gauge(name string) metrics.IGauge {
 }
 
 func (p *Client) RegistryHistogram(name, help string, buckets []float64, constLabels metrics.Labels, labels ...string) metrics.IHistogram {
-	p.histogramCollectorLocker.Lock()
-	defer p.histogramCollectorLocker.Unlock()
-
-	if _, ok := p.histogramCollector[name]; ok {
-		p.app.Fatal("重复注册 metrics Histogram 直方图")
-	}
-
-	histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{
-		Namespace:   "",
-		Subsystem:   "",
-		Name:        name,
-		Help:        help,
-		ConstLabels: constLabels,
-		Buckets:     buckets,
-	}, labels)
-	err := p.registryCollector(histogram)
+	h, err := p.TryRegistryHistogram(name, help, buckets, constLabels, labels...)
 	if err != nil {
-		p.app.Fatal("注册 metrics Histogram 直方图失败", zap.Error(err))
+		p.app.Fatal("注册 metrics Histogram 直方图失败", zap.String("name", name), zap.Error(err))
 	}
-
-	h := &histogramCli{name, histogram}
-	p.histogramCollector[name] = h
 	return h
 }
+
+// 注册直方图, 重复注册签名一致的直方图时返回已注册的直方图, 签名不一致时返回 *RegistryConflictError.
+// 在 NativeHistograms 中配置了的直方图同时启用原生直方图
+func (p *Client) TryRegistryHistogram(name, help string, buckets []float64, constLabels metrics.Labels, labels ...string) (metrics.IHistogram, error) {
+	if native, ok := p.conf.NativeHistograms[name]; ok {
+		return p.TryRegistryNativeHistogram(name, help, native, buckets, constLabels, labels...)
+	}
+	return p.tryRegistryHistogram(name, help, buckets, nil, constLabels, labels...)
+}
 func (p *Client) Histogram(name string) metrics.IHistogram {
 	p.histogramCollectorLocker.RLock()
 	defer p.histogramCollectorLocker.RUnlock()
@@ -377,29 +550,18 @@ func (p *Client) Histogram(name string) metrics.IHistogram {
 }
 
 func (p *Client) RegistrySummary(name, help string, constLabels metrics.Labels, labels ...string) metrics.ISummary {
-	p.summaryCollectorLocker.Lock()
-	defer p.summaryCollectorLocker.Unlock()
-
-	if _, ok := p.summaryCollector[name]; ok {
-		p.app.Fatal("重复注册 metrics Summary 汇总")
-	}
-
-	summary := prometheus.NewSummaryVec(prometheus.SummaryOpts{
-		Namespace:   "",
-		Subsystem:   "",
-		Name:        name,
-		Help:        help,
-		ConstLabels: constLabels,
-	}, labels)
-	err := p.registryCollector(summary)
+	s, err := p.TryRegistrySummary(name, help, constLabels, labels...)
 	if err != nil {
-		p.app.Fatal("注册 metrics Summary 汇总失败", zap.Error(err))
+		p.app.Fatal("注册 metrics Summary 汇总失败", zap.String("name", name), zap.Error(err))
 	}
-
-	s := &summaryCli{name, summary}
-	p.summaryCollector[name] = s
 	return s
 }
+
+// 注册汇总, 重复注册签名一致的汇总时返回已注册的汇总, 签名不一致时返回 *RegistryConflictError.
+// 分位数和保留时间使用 Summaries 中的配置, 未配置时使用默认值
+func (p *Client) TryRegistrySummary(name, help string, constLabels metrics.Labels, labels ...string) (metrics.ISummary, error) {
+	return p.TryRegistrySummaryWithConfig(name, help, p.conf.Summaries[name], constLabels, labels...)
+}
 func (p *Client) Summary(name string) metrics.ISummary {
 	p.summaryCollectorLocker.RLock()
 	defer p.summaryCollectorLocker.RUnlock()
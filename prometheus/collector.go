@@ -9,6 +9,7 @@ import (
 )
 
 type counterCli struct {
+	*series
 	name    string
 	counter *prometheus.CounterVec
 }
@@ -18,6 +19,10 @@ func (c *counterCli) Inc(labels metrics.Labels, exemplar metrics.Labels) {
 }
 
 func (c *counterCli) Add(v float64, labels metrics.Labels, exemplar metrics.Labels) {
+	labels, ok := c.admit(labels)
+	if !ok {
+		return
+	}
 	counter, err := c.counter.GetMetricWith(labels)
 	if err != nil {
 		log.Error("获取 metrics Counter 计数器失败", zap.String("name", c.name), zap.Error(err))
@@ -34,11 +39,16 @@ func (c *counterCli) Add(v float64, labels metrics.Labels, exemplar metrics.Labe
 }
 
 type gaugeCli struct {
+	*series
 	name  string
 	gauge *prometheus.GaugeVec
 }
 
 func (g *gaugeCli) Set(v float64, labels metrics.Labels) {
+	labels, ok := g.admit(labels)
+	if !ok {
+		return
+	}
 	gauge, err := g.gauge.GetMetricWith(labels)
 	if err != nil {
 		log.Error("获取 metrics Gauge 计量器失败", zap.String("name", g.name), zap.Error(err))
@@ -47,6 +57,10 @@ func (g *gaugeCli) Set(v float64, labels metrics.Labels) {
 	gauge.Set(v)
 }
 func (g *gaugeCli) Inc(labels metrics.Labels) {
+	labels, ok := g.admit(labels)
+	if !ok {
+		return
+	}
 	gauge, err := g.gauge.GetMetricWith(labels)
 	if err != nil {
 		log.Error("获取 metrics Gauge 计量器失败", zap.String("name", g.name), zap.Error(err))
@@ -55,6 +69,10 @@ func (g *gaugeCli) Inc(labels metrics.Labels) {
 	gauge.Inc()
 }
 func (g *gaugeCli) Dec(labels metrics.Labels) {
+	labels, ok := g.admit(labels)
+	if !ok {
+		return
+	}
 	gauge, err := g.gauge.GetMetricWith(labels)
 	if err != nil {
 		log.Error("获取 metrics Gauge 计量器失败", zap.String("name", g.name), zap.Error(err))
@@ -63,6 +81,10 @@ func (g *gaugeCli) Dec(labels metrics.Labels) {
 	gauge.Dec()
 }
 func (g *gaugeCli) Add(v float64, labels metrics.Labels) {
+	labels, ok := g.admit(labels)
+	if !ok {
+		return
+	}
 	gauge, err := g.gauge.GetMetricWith(labels)
 	if err != nil {
 		log.Error("获取 metrics Gauge 计量器失败", zap.String("name", g.name), zap.Error(err))
@@ -71,6 +93,10 @@ func (g *gaugeCli) Add(v float64, labels metrics.Labels) {
 	gauge.Add(v)
 }
 func (g *gaugeCli) Sub(v float64, labels metrics.Labels) {
+	labels, ok := g.admit(labels)
+	if !ok {
+		return
+	}
 	gauge, err := g.gauge.GetMetricWith(labels)
 	if err != nil {
 		log.Error("获取 metrics Gauge 计量器失败", zap.String("name", g.name), zap.Error(err))
@@ -79,6 +105,10 @@ func (g *gaugeCli) Sub(v float64, labels metrics.Labels) {
 	gauge.Sub(v)
 }
 func (g *gaugeCli) SetToCurrentTime(labels metrics.Labels) {
+	labels, ok := g.admit(labels)
+	if !ok {
+		return
+	}
 	gauge, err := g.gauge.GetMetricWith(labels)
 	if err != nil {
 		log.Error("获取 metrics Gauge 计量器失败", zap.String("name", g.name), zap.Error(err))
@@ -88,11 +118,16 @@ func (g *gaugeCli) SetToCurrentTime(labels metrics.Labels) {
 }
 
 type histogramCli struct {
+	*series
 	name      string
 	histogram *prometheus.HistogramVec
 }
 
 func (h *histogramCli) Observe(v float64, labels metrics.Labels, exemplar metrics.Labels) {
+	labels, ok := h.admit(labels)
+	if !ok {
+		return
+	}
 	histogram, err := h.histogram.GetMetricWith(labels)
 	if err != nil {
 		log.Error("获取 metrics Histogram 直方图失败", zap.String("name", h.name), zap.Error(err))
@@ -109,11 +144,16 @@ func (h *histogramCli) Observe(v float64, labels metrics.Labels, exemplar metric
 }
 
 type summaryCli struct {
+	*series
 	name    string
 	summary *prometheus.SummaryVec
 }
 
 func (s *summaryCli) Observe(v float64, labels metrics.Labels, exemplar metrics.Labels) {
+	labels, ok := s.admit(labels)
+	if !ok {
+		return
+	}
 	summary, err := s.summary.GetMetricWith(labels)
 	if err != nil {
 		log.Error("获取 metrics Summary 汇总失败", zap.String("name", s.name), zap.Error(err))
@@ -1,58 +1,206 @@
 package prometheus
 
 import (
+	"github.com/zly-app/zapp/log"
 	"github.com/zly-app/zapp/pkg/utils"
 )
 
 const (
 	defaultProcessCollector = true
-	defaultGoCollector = true
+	defaultGoCollector      = true
+	defaultBuildInfo        = true
+	defaultCloseTimeout     = 5000
+
+	defaultSeriesExpireInterval = 10000
+	defaultSeriesOverflowMode   = SeriesOverflowModeOverflow
 
 	defaultPullPath = "/metrics"
 
-	defaultPushTimeInterval = 10000
-	defaultPushRetry = 2
+	defaultPushTimeInterval  = 10000
+	defaultPushRetry         = 2
 	defaultPushRetryInterval = 1000
+	defaultPushMethod        = PushMethodPush
+
+	defaultWriteTimeInterval      = 10000
+	defaultWriteRetry             = 2
+	defaultWriteRetryInterval     = 1000
+	defaultWriteProtocolVersion   = RemoteWriteProtocolV1
+	defaultWriteWALMaxSize        = 256 << 20
+	defaultWriteShards            = 1
+	defaultWriteMaxSamplesPerSend = 2000
+	defaultWriteRetryMaxInterval  = 30000
+
+	defaultStatsdFormat        = StatsdFormatStatsd
+	defaultStatsdFlushInterval = 10000
+	defaultStatsdMaxPacketSize = 1432
 
-	defaultWriteTimeInterval = 10000
-	defaultWriteRetry = 2
-	defaultWriteRetryInterval = 1000
+	defaultInfluxTimeInterval  = 10000
+	defaultInfluxMaxPacketSize = 1432
 )
 
 type Config struct {
-	ProcessCollector  bool // 启用进程收集器
-	GoCollector       bool // 启用go收集器
-	EnableOpenMetrics bool // 启用 OpenMetrics 格式
+	ProcessCollector  bool  // 启用进程收集器
+	GoCollector       bool  // 启用go收集器
+	BuildInfo         bool  // 启用构建信息收集器, 导出 zapp_build_info 和 zapp_start_time_seconds
+	EnableOpenMetrics bool  // 启用 OpenMetrics 格式
+	CloseTimeout      int64 // 关闭超时, 单位毫秒, 关闭时会在此时间内关闭pull模式服务并完成最后一次推送和写入
+
+	/*启用容器收集器, 导出当前进程所在 cgroup(v1 或 v2) 的 CPU 配额, 限流, 内存限制和使用量, 指标名以 zapp_container_ 为前缀
+	  用于在 Kubernetes 中观察是否接近 OOM 或 CPU 限流, 非 linux 系统不会导出任何指标.
+	*/
+	ContainerCollector bool
+	/*go收集器额外收集的 runtime/metrics 分组, 可选 gc, memory, scheduler, all
+	  gc: GC 相关指标, 包括 GC 暂停时间直方图.
+	  memory: 按类别统计的内存.
+	  scheduler: 调度器相关指标, 包括调度延迟直方图 /sched/latencies:seconds.
+	*/
+	GoCollectorMetrics         []string
+	GoCollectorRules           []string // go收集器额外收集的 runtime/metrics 名称的正则表达式, 如: ['^/sched/latencies:seconds$', '^/gc/pauses:seconds$']
+	GoCollectorDisableMemStats bool     // go收集器不收集 runtime.MemStats 的指标(go_memstats_*), 可以使用 memory 分组代替
 
-	PullBind string // pull模式bind地址, 如: ':9100', 如果为空则不启用pull模式
+	/*配置热更新监听的配置分组和key, 都不为空时启用
+	  值为 yaml 格式, 内容与 plugin.metrics 下的配置一致. 变化后会按新的配置重建 push模式, RemoteWrite 模式,
+	  StatsD 模式和 InfluxDB 模式的发送器, 并替换 pull模式的访问控制, 其它配置需要重启后生效.
+	*/
+	WatchGroup string
+	WatchKey   string
+
+	/*按指标名设置时间序列过期时间, 单位毫秒, 如: {"tenant_connections": 600000}
+	  超过这个时间未更新的时间序列会被删除, 用于标签值会不断变化的指标.
+	*/
+	SeriesTTL            map[string]int64
+	SeriesExpireInterval int64          // 检查过期时间序列的间隔, 单位毫秒
+	SeriesLimit          int            // 每个指标的最大时间序列数, 0 表示不限制
+	SeriesLimits         map[string]int // 按指标名设置最大时间序列数, 优先于 SeriesLimit, 如: {"http_requests_total": 1000}
+	/*超出时间序列数量限制后的处理方式, 可选 overflow, drop
+	  overflow: 计入所有标签值为 __overflow__ 的时间序列.
+	  drop: 丢弃.
+	  被拒绝的观测次数记录在 metrics_rejected_observations_total 指标中, 同一个时间序列的每次观测都会计数.
+	*/
+	SeriesOverflowMode string
+
+	/*按指标名启用原生直方图, 如: {"http_request_duration_seconds": {"BucketFactor": 1.1}}
+	  通过 RegistryHistogram 注册时同时启用原生直方图, 注册时 buckets 为空则只有原生直方图.
+	*/
+	NativeHistograms map[string]NativeHistogramConfig
+	/*按指标名配置汇总的分位数和保留时间, 如: {"rpc_duration_seconds": {"Objectives": [{"Quantile": 0.99, "Error": 0.001}]}}
+	  未配置的汇总使用默认分位数 p50, p90, p99, 保留时间 10 分钟.
+	*/
+	Summaries map[string]SummaryConfig
+	/*在配置中声明的指标, 在创建客户端时注册, 代码中通过 Counter, Gauge, Histogram, Summary 获取
+	  代码中重复注册同名指标时只检查类型和标签, 描述, 常量标签, 分桶和分位数以配置为准.
+	*/
+	Metrics []MetricConfig
+
+	PullBind string // pull模式bind地址, 如: ':9100', 如果为空则不开启单独的端口. 单独的端口会同时提供 /-/healthy 和 /-/ready 检查接口
 	PullPath string // pull模式拉取路径, 如: '/metrics'
+	/*pull模式挂载到的 zapp 服务类型, 如: 'http', 如果为空则不挂载
+	  服务需要实现 HandlerMounter 接口, 挂载后无需通过 PullBind 单独开启端口.
+	  只挂载 PullPath, 不挂载 /-/healthy 和 /-/ready 检查接口, 避免与服务已有的路由冲突.
+	*/
+	PullService string
+	/*pull模式 TLS 证书和私钥文件, 同时设置时启用 https
+	  证书或私钥文件变化后自动重新加载.
+	*/
+	PullTLSCertFile       string
+	PullTLSKeyFile        string
+	PullBasicAuthUser     string   // pull模式 basic auth 用户名, 如果为空则不校验
+	PullBasicAuthPassword string   // pull模式 basic auth 密码
+	PullBearerToken       string   // pull模式 bearer token, 如果为空则不校验. 同时配置了 basic auth 时满足其一即可
+	PullAllowCIDRs        []string // pull模式允许访问的ip或网段, 如: ['127.0.0.1', '10.0.0.0/8'], 如果为空则不限制
 
 	PushAddress string // push模式 pushGateway地址, 如果为空则不启用push模式, 如: 'http://127.0.0.1:9091'
 	/*push模式 instance 标记的值
 	  这个值用于区分相同服务的不同实例.
 	  如果为空则设为主机名, 如果无法获取主机名则设为app名.
 	*/
-	PushInstance      string // 实例, 一般为ip或主机名
-	PushTimeInterval  int64  // push模式推送时间间隔, 单位毫秒
-	PushRetry         uint32 // push模式推送重试次数
-	PushRetryInterval int64  // push模式推送重试时间间隔, 单位毫秒
+	PushInstance       string            // 实例, 一般为ip或主机名
+	PushTimeInterval   int64             // push模式推送时间间隔, 单位毫秒
+	PushRetry          uint32            // push模式推送重试次数
+	PushRetryInterval  int64             // push模式推送重试时间间隔, 单位毫秒
+	PushHTTP           HTTPClientConfig  // push模式 http 客户端配置, 包括认证, 额外请求头和 TLS
+	PushRelabelConfigs []RelabelConfig   // push模式推送前的重新标记规则, 与 Prometheus 的 metric_relabel_configs 一致
+	PushJob            string            // push模式 job 名, 如果为空则使用app名
+	PushGrouping       map[string]string // push模式额外的分组标签, 如: {"zone": "sh"}. Frame.Labels, app, env, instance 总是作为分组标签, Frame.Labels 的标签名不合法的字符替换为 _
+	PushDeleteOnExit   bool              // push模式在关闭时从 pushGateway 删除本实例的分组, 不再进行最后一次推送, 避免残留已下线的实例
+	/*push模式推送方法, 可选 push, add
+	  push: 使用 PUT, 替换分组中的所有指标.
+	  add: 使用 POST, 只替换同名的指标.
+	*/
+	PushMethod string
+
+	WriteAddress           string           // RemoteWrite 地址, 如果为空则不启用
+	WriteInstance          string           // 实例, 一般为ip或主机名
+	WriteTimeInterval      int64            // RemoteWrite 模式推送时间间隔, 单位毫秒
+	WriteRetry             uint32           // RemoteWrite 模式推送重试次数, 只有网络错误, 5xx 和 429 会重试, 其它 4xx 直接丢弃
+	WriteRetryInterval     int64            // RemoteWrite 模式推送重试时间间隔, 单位毫秒, 每次重试后翻倍. 服务端返回 Retry-After 时以其为准
+	WriteRetryMaxInterval  int64            // RemoteWrite 模式推送最大重试时间间隔, 单位毫秒
+	WriteShards            int              // RemoteWrite 分片数, 时间序列按标签哈希分配到各个分片并发发送
+	WriteMaxSamplesPerSend int              // RemoteWrite 每次请求的最大样本数, 超出后拆分为多个请求
+	WriteHTTP              HTTPClientConfig // RemoteWrite 模式 http 客户端配置, 包括认证, 额外请求头和 TLS
+	WriteRelabelConfigs    []RelabelConfig  // RemoteWrite 发送前的重新标记规则, 与 Prometheus 的 write_relabel_configs 一致, 作用于包括 Frame.Labels, app, env, instance 在内的所有标签, 如: 去除高基数的标签
+	/*RemoteWrite 协议版本, 可选 1.0, 2.0
+	  2.0 使用 io.prometheus.write.v2.Request, 支持符号表, 元数据, 创建时间戳和原生直方图.
+	  接收端需要支持 Remote Write 2.0, 如 Prometheus 3.x 或 Mimir.
+	*/
+	WriteProtocolVersion string
+	/*RemoteWrite 预写日志目录, 如果为空则不启用
+	  启用后未发送成功的数据会持久化到此目录, 接收端恢复后(包括进程重启后)按顺序重放.
+	*/
+	WriteWALDir     string
+	WriteWALMaxSize int64 // 预写日志最大占用磁盘大小, 单位字节, 超出后丢弃最旧的数据
+	/*多个 RemoteWrite 目标, 每个目标有独立的地址, 认证, 请求头, 推送间隔, 重新标记规则和发送队列
+	  配置了 WriteAddress 时其作为第一个目标, 名称为 default.
+	  相同推送间隔的目标每次共用同一次收集的数据.
+	*/
+	RemoteWrites []RemoteWriteConfig
+
+	/*StatsD 地址, 如果为空则不启用
+	  如: '127.0.0.1:8125', 'udp://127.0.0.1:8125', 'unix:///var/run/datadog/dsd.socket'.
+	  注册的指标会按 StatsdFormat 格式定时发送, 标签会转换为 tags. 直方图只发送 _sum 和 _count, 不发送分桶.
+	*/
+	StatsdAddress       string
+	StatsdFormat        string // StatsD 格式, 可选 statsd, dogstatsd. statsd 的标签格式为 name,k=v:1|c, dogstatsd 的标签格式为 name:1|c|#k:v
+	StatsdPrefix        string // StatsD 指标名前缀, 如: 'myapp.'
+	StatsdFlushInterval int64  // StatsD 发送时间间隔, 单位毫秒
+	StatsdMaxPacketSize int    // StatsD 每个包的最大字节数, 多个指标会合并到一个包中发送
 
-	WriteAddress       string // RemoteWrite 地址, 如果为空则不启用
-	WriteInstance      string // 实例, 一般为ip或主机名
-	WriteTimeInterval  int64  // RemoteWrite 模式推送时间间隔, 单位毫秒
-	WriteRetry         uint32 // RemoteWrite 模式推送重试次数
-	WriteRetryInterval int64  // RemoteWrite 模式推送重试时间间隔, 单位毫秒
+	/*InfluxDB 地址, 如果为空则不启用
+	  如: 'http://127.0.0.1:8086' 通过 /api/v2/write 写入, 'udp://127.0.0.1:8089' 通过 UDP 写入.
+	  注册的指标会定时转换为行协议发送, measurement 为指标名, 标签为 tag.
+	  http 与 RemoteWrite 模式一样总是压缩请求体(gzip), 并使用 WriteRetry, WriteRetryInterval 和 WriteRetryMaxInterval 重试.
+	  UDP 的时间戳精度为纳秒, 与 InfluxDB UDP 服务的默认精度一致.
+	*/
+	InfluxAddress       string
+	InfluxOrg           string           // InfluxDB 组织, 仅 http 有效
+	InfluxBucket        string           // InfluxDB bucket, 仅 http 有效
+	InfluxToken         string           // InfluxDB token, 仅 http 有效. 优先于 InfluxHTTP 中的认证, 同时设置时忽略 InfluxHTTP 中的认证
+	InfluxTimeInterval  int64            // InfluxDB 写入时间间隔, 单位毫秒
+	InfluxHTTP          HTTPClientConfig // InfluxDB http 客户端配置, 包括认证, 额外请求头和 TLS. 设置了 InfluxToken 时其中的认证无效
+	InfluxMaxPacketSize int              // InfluxDB UDP 每个包的最大字节数, 多行数据会合并到一个包中发送
 }
 
 func newConfig() *Config {
 	return &Config{
 		ProcessCollector: defaultProcessCollector,
 		GoCollector:      defaultGoCollector,
+		BuildInfo:        defaultBuildInfo,
 		PushRetry:        defaultPushRetry,
 	}
 }
 
 func (conf *Config) Check() {
+	if conf.CloseTimeout < 1 {
+		conf.CloseTimeout = defaultCloseTimeout
+	}
+
+	if conf.SeriesExpireInterval < 1 {
+		conf.SeriesExpireInterval = defaultSeriesExpireInterval
+	}
+	if conf.SeriesOverflowMode != SeriesOverflowModeDrop {
+		conf.SeriesOverflowMode = defaultSeriesOverflowMode
+	}
+
 	if conf.PullPath == "" {
 		conf.PullPath = defaultPullPath
 	}
@@ -66,6 +214,9 @@ func (conf *Config) Check() {
 	if conf.PushRetryInterval < 1 {
 		conf.PushRetryInterval = defaultPushRetryInterval
 	}
+	if conf.PushMethod != PushMethodAdd {
+		conf.PushMethod = defaultPushMethod
+	}
 
 	if conf.WriteInstance == "" {
 		conf.WriteInstance = utils.GetInstance("")
@@ -76,4 +227,50 @@ func (conf *Config) Check() {
 	if conf.WriteRetryInterval < 1 {
 		conf.WriteRetryInterval = defaultWriteRetryInterval
 	}
+	if conf.WriteProtocolVersion != RemoteWriteProtocolV2 {
+		conf.WriteProtocolVersion = defaultWriteProtocolVersion
+	}
+	if conf.WriteWALMaxSize < 1 {
+		conf.WriteWALMaxSize = defaultWriteWALMaxSize
+	}
+	if conf.WriteRetryMaxInterval < 1 {
+		conf.WriteRetryMaxInterval = defaultWriteRetryMaxInterval
+	}
+	if conf.WriteRetryMaxInterval < conf.WriteRetryInterval {
+		conf.WriteRetryMaxInterval = conf.WriteRetryInterval
+	}
+	if conf.WriteShards < 1 {
+		conf.WriteShards = defaultWriteShards
+	}
+	if conf.WriteMaxSamplesPerSend < 1 {
+		conf.WriteMaxSamplesPerSend = defaultWriteMaxSamplesPerSend
+	}
+	for i := range conf.RemoteWrites {
+		conf.RemoteWrites[i].check()
+	}
+
+	if conf.StatsdFormat != StatsdFormatDogStatsd {
+		conf.StatsdFormat = defaultStatsdFormat
+	}
+	if conf.StatsdFlushInterval < 1 {
+		conf.StatsdFlushInterval = defaultStatsdFlushInterval
+	}
+	if conf.StatsdMaxPacketSize < 1 {
+		conf.StatsdMaxPacketSize = defaultStatsdMaxPacketSize
+	}
+
+	if conf.InfluxTimeInterval < 1 {
+		conf.InfluxTimeInterval = defaultInfluxTimeInterval
+	}
+	if conf.InfluxMaxPacketSize < 1 {
+		conf.InfluxMaxPacketSize = defaultInfluxMaxPacketSize
+	}
+	// InfluxToken 优先, 否则 InfluxHTTP 的认证会覆盖 Authorization 请求头
+	if conf.InfluxToken != "" {
+		auth := &conf.InfluxHTTP
+		if auth.BasicAuthUser != "" || auth.BearerToken != "" || auth.BearerTokenFile != "" {
+			log.Warn("metrics 同时设置了 InfluxToken 和 InfluxHTTP 的认证, 忽略 InfluxHTTP 的认证")
+			auth.BasicAuthUser, auth.BasicAuthPassword, auth.BearerToken, auth.BearerTokenFile = "", "", "", ""
+		}
+	}
 }
@@ -0,0 +1,93 @@
+package prometheus
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/opentracing/opentracing-go"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/zly-app/zapp/component/metrics"
+)
+
+// 支持 context 的计数器, 自动将 ctx 中 span 的 trace_id 和 span_id 作为 Exemplar
+//
+// 注册的 Counter 实现了这个接口. Exemplar 需要通过 OpenMetrics 格式拉取(EnableOpenMetrics)或通过 RemoteWrite 发送.
+type CounterCtx interface {
+	IncCtx(ctx context.Context, labels metrics.Labels)
+	AddCtx(ctx context.Context, v float64, labels metrics.Labels)
+}
+
+// 支持 context 的观测器, 自动将 ctx 中 span 的 trace_id 和 span_id 作为 Exemplar
+//
+// 注册的 Histogram 和 Summary 实现了这个接口, Summary 不支持 Exemplar, 会忽略 ctx 中的 span.
+type ObserverCtx interface {
+	ObserveCtx(ctx context.Context, v float64, labels metrics.Labels)
+}
+
+func (c *counterCli) IncCtx(ctx context.Context, labels metrics.Labels) {
+	c.Add(1, labels, traceExemplar(ctx))
+}
+
+func (c *counterCli) AddCtx(ctx context.Context, v float64, labels metrics.Labels) {
+	c.Add(v, labels, traceExemplar(ctx))
+}
+
+func (h *histogramCli) ObserveCtx(ctx context.Context, v float64, labels metrics.Labels) {
+	h.Observe(v, labels, traceExemplar(ctx))
+}
+
+func (s *summaryCli) ObserveCtx(_ context.Context, v float64, labels metrics.Labels) {
+	s.Observe(v, labels, nil)
+}
+
+// 从 ctx 中的 OpenTelemetry 或 OpenTracing span 提取 Exemplar, 没有 span 或未采样时返回 nil
+func traceExemplar(ctx context.Context) metrics.Labels {
+	if ctx == nil {
+		return nil
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		if !sc.IsSampled() {
+			return nil
+		}
+		return metrics.Labels{"trace_id": sc.TraceID().String(), "span_id": sc.SpanID().String()}
+	}
+
+	// OpenTracing 的 SpanContext 由实现决定, 通过注入到 TextMap 中解析 W3C traceparent 或 jaeger uber-trace-id
+	span := opentracing.SpanFromContext(ctx)
+	if span == nil {
+		return nil
+	}
+	carrier := opentracing.TextMapCarrier{}
+	if err := span.Tracer().Inject(span.Context(), opentracing.TextMap, carrier); err != nil {
+		return nil
+	}
+	for k, v := range carrier {
+		switch strings.ToLower(k) {
+		case "traceparent": // {version}-{trace-id}-{span-id}-{flags}
+			parts := strings.Split(v, "-")
+			if len(parts) != 4 || !isSampledFlags(parts[3]) {
+				return nil
+			}
+			return metrics.Labels{"trace_id": parts[1], "span_id": parts[2]}
+		case "uber-trace-id": // {trace-id}:{span-id}:{parent-span-id}:{flags}
+			if unescaped, err := url.QueryUnescape(v); err == nil {
+				v = unescaped
+			}
+			parts := strings.Split(v, ":")
+			if len(parts) != 4 || !isSampledFlags(parts[3]) {
+				return nil
+			}
+			return metrics.Labels{"trace_id": parts[0], "span_id": parts[1]}
+		}
+	}
+	return nil
+}
+
+// flags 为十六进制, 最低位为采样标记
+func isSampledFlags(flags string) bool {
+	v, err := strconv.ParseUint(flags, 16, 8)
+	return err == nil && v&1 == 1
+}
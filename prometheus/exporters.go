@@ -0,0 +1,276 @@
+package prometheus
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/prometheus/common/expfmt"
+)
+
+// 发送器, 包括 push模式, RemoteWrite 模式, StatsD 模式和 InfluxDB 模式
+//
+// 配置热更新时按新的配置整体重建, 创建成功后再停止原来的发送器并替换.
+type exporters struct {
+	conf            *Config
+	pusher          *push.Pusher   // push模式推送器
+	pushClient      *http.Client   // push模式推送器的 http 客户端
+	pushJob         string         // push模式的 job
+	pushGroup       string         // push模式的分组, 包括地址, job 和分组标签
+	deletePushGroup bool           // 停止时删除 push模式的分组, 而不是最后推送一次
+	writeTargets    []*writeTarget // RemoteWrite 目标
+	statsd          *statsdSink    // StatsD 发送器
+	influx          *influxSink    // InfluxDB 发送器
+
+	ctx    context.Context // 停止时取消
+	cancel context.CancelFunc
+	wg     sync.WaitGroup // 等待推送和写入循环退出
+}
+
+// 按配置创建并打开发送器, 失败时关闭已创建的部分
+func (p *Client) newExporters(conf *Config) (*exporters, error) {
+	e, err := p.prepareExporters(conf)
+	if err != nil {
+		return nil, err
+	}
+	if err = p.openExporters(e, nil); err != nil {
+		_ = p.stopExporters(context.Background(), e, false)
+		return nil, err
+	}
+	return e, nil
+}
+
+// 按配置创建发送器并检查配置, 不打开预写日志, 失败时关闭已创建的部分
+func (p *Client) prepareExporters(conf *Config) (*exporters, error) {
+	e := &exporters{conf: conf}
+	e.ctx, e.cancel = context.WithCancel(p.ctx)
+	err := p.buildExporters(e)
+	if err != nil {
+		_ = p.stopExporters(context.Background(), e, false)
+		return nil, err
+	}
+	return e, nil
+}
+
+// 创建 RemoteWrite 目标的发送队列并打开预写日志
+//
+// 热更新时可以在原来的发送器停止前调用, 新的目标与原来的目标使用相同的预写日志目录时复用原来已打开的预写日志.
+func (p *Client) openExporters(e *exporters, old *exporters) error {
+	wals := make(map[string]*writeWAL)
+	if old != nil {
+		for _, t := range old.writeTargets {
+			if t.queue != nil && t.queue.wal != nil {
+				wals[filepath.Clean(t.conf.WALDir)] = t.queue.wal
+			}
+		}
+	}
+
+	for _, t := range e.writeTargets {
+		var wal *writeWAL
+		if t.conf.WALDir != "" {
+			wal = wals[filepath.Clean(t.conf.WALDir)]
+		}
+		queue, err := newWriteQueue(p.app, t.conf, t.write, p.selfMetrics, wal)
+		if err != nil {
+			return fmt.Errorf("metrics remote write target %s open wal %q err: %v", t.conf.Name, t.conf.WALDir, err)
+		}
+		t.queue = queue
+	}
+	return nil
+}
+
+func (p *Client) buildExporters(e *exporters) error {
+	conf := e.conf
+	frame := p.app.GetConfig().Config().Frame
+
+	if conf.PushAddress != "" {
+		rules, err := newRelabelRules(conf.PushRelabelConfigs)
+		if err != nil {
+			return fmt.Errorf("metrics push mode relabel config err: %v", err)
+		}
+		job := conf.PushJob
+		if job == "" {
+			job = p.app.Name()
+		}
+		httpClient, err := newHTTPClient(&conf.PushHTTP)
+		if err != nil {
+			return fmt.Errorf("metrics push mode http client err: %v", err)
+		}
+
+		pusher := push.New(conf.PushAddress, job).Gatherer(newRelabelGatherer(p.gatherers, rules, nil))
+		if conf.EnableOpenMetrics {
+			pusher.Format(expfmt.NewFormat(expfmt.TypeOpenMetrics))
+		}
+		grouping := make(map[string]string, len(conf.PushGrouping)+len(frame.Labels)+3)
+		for k, v := range conf.PushGrouping {
+			grouping[k] = v
+		}
+		for k, v := range sanitizeFrameLabels(p.app, "push模式分组") {
+			grouping[k] = v
+		}
+		grouping["app"] = p.app.Name()
+		grouping["env"] = frame.Env
+		grouping["instance"] = conf.PushInstance
+		for k, v := range grouping {
+			pusher.Grouping(k, v)
+		}
+		pusher.Client(&selfMetricsDoer{client: httpClient, metrics: p.selfMetrics, exporter: exporterPush, target: job})
+		e.pusher = pusher
+		e.pushClient = httpClient
+		e.pushJob = job
+		e.pushGroup = pushGroupKey(conf.PushAddress, job, grouping)
+		e.deletePushGroup = conf.PushDeleteOnExit
+	}
+
+	writeConfs, err := conf.remoteWriteTargets()
+	if err != nil {
+		return fmt.Errorf("metrics remote write config err: %v", err)
+	}
+	for _, writeConf := range writeConfs {
+		rules, err := newRelabelRules(writeConf.RelabelConfigs)
+		if err != nil {
+			return fmt.Errorf("metrics remote write target %s relabel config err: %v", writeConf.Name, err)
+		}
+		httpClient, err := newHTTPClient(&writeConf.HTTP)
+		if err != nil {
+			return fmt.Errorf("metrics remote write target %s http client err: %v", writeConf.Name, err)
+		}
+
+		// 附加的标签在重新标记前加入, 重新标记规则可以修改或删除
+		external := sanitizeFrameLabels(p.app, "RemoteWrite 附加标签")
+		external["app"] = p.app.Name()
+		external["env"] = frame.Env
+		external["instance"] = writeConf.Instance
+
+		snapshot := &snapshotGatherer{}
+		write := NewRemoteWrite(writeConf.Address).Gatherer(newRelabelGatherer(snapshot, rules, external))
+		if conf.EnableOpenMetrics {
+			write.FormatType(expfmt.TypeOpenMetrics)
+		}
+		write.ProtocolVersion(writeConf.ProtocolVersion)
+		write.Client(httpClient)
+
+		if writeConf.WALDir != "" {
+			if err := os.MkdirAll(writeConf.WALDir, 0755); err != nil {
+				return fmt.Errorf("metrics remote write target %s create wal dir %q err: %v", writeConf.Name, writeConf.WALDir, err)
+			}
+		}
+		e.writeTargets = append(e.writeTargets, &writeTarget{conf: writeConf, write: write, snapshot: snapshot})
+	}
+
+	tags := make(map[string]string, len(frame.Labels)+2)
+	for k, v := range frame.Labels {
+		tags[k] = v
+	}
+	tags["app"] = p.app.Name()
+	tags["env"] = frame.Env
+
+	if conf.StatsdAddress != "" {
+		sink, err := newStatsdSink(conf, p.gatherers, tags)
+		if err != nil {
+			return fmt.Errorf("metrics statsd mode err: %v", err)
+		}
+		e.statsd = sink
+	}
+	if conf.InfluxAddress != "" {
+		sink, err := newInfluxSink(p.app, conf, p.gatherers, tags, p.selfMetrics)
+		if err != nil {
+			return fmt.Errorf("metrics influx mode err: %v", err)
+		}
+		e.influx = sink
+	}
+	return nil
+}
+
+// 启动发送器的推送和写入循环
+func (p *Client) startExporters(e *exporters) {
+	p.selfMetrics.setWriteQueues(e.writeTargets)
+	p.startPushMode(e)
+	p.startRemoteWrite(e)
+	p.startStatsd(e)
+	p.startInflux(e)
+}
+
+// 停止发送器, final 为 true 时在 ctx 内完成最后一次推送和写入
+func (p *Client) stopExporters(ctx context.Context, e *exporters, final bool) []error {
+	e.cancel()
+	e.wg.Wait()
+
+	var errs []error
+	if final {
+		if e.pusher != nil && e.deletePushGroup {
+			if err := p.deletePushGroup(ctx, e); err != nil {
+				errs = append(errs, fmt.Errorf("metrics push delete group err: %v", err))
+			}
+		} else if e.pusher != nil {
+			if err := p.pushOnce(ctx, e.conf, e.pusher); err != nil {
+				errs = append(errs, fmt.Errorf("metrics final push err: %v", err))
+			}
+		}
+		if len(e.writeTargets) > 0 {
+			if err := writeTargetsOnce(ctx, p.gatherers, e.writeTargets); err != nil {
+				errs = append(errs, fmt.Errorf("metrics final remote write err: %v", err))
+			}
+		}
+		if e.statsd != nil {
+			if err := e.statsd.Flush(); err != nil {
+				errs = append(errs, fmt.Errorf("metrics final statsd flush err: %v", err))
+			}
+		}
+		if e.influx != nil {
+			if err := e.influx.Write(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("metrics final influx write err: %v", err))
+			}
+		}
+	}
+
+	if e.statsd != nil {
+		_ = e.statsd.Close()
+	}
+	if e.influx != nil {
+		_ = e.influx.Close()
+	}
+	return errs
+}
+
+// 自身指标的 exporter 和 target 标签
+func (e *exporters) selfMetricsTargets() [][2]string {
+	var ret [][2]string
+	if e.pusher != nil {
+		ret = append(ret, [2]string{exporterPush, e.pushJob})
+	}
+	for _, t := range e.writeTargets {
+		ret = append(ret, [2]string{exporterRemoteWrite, t.conf.Name})
+	}
+	if e.influx != nil {
+		ret = append(ret, [2]string{exporterInflux, e.influx.target})
+	}
+	return ret
+}
+
+// push模式分组的标识, 地址, job 和分组标签都相同时为同一个分组
+func pushGroupKey(address, job string, grouping map[string]string) string {
+	keys := make([]string, 0, len(grouping))
+	for k := range grouping {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(address)
+	b.WriteString("\x00")
+	b.WriteString(job)
+	for _, k := range keys {
+		b.WriteString("\x00")
+		b.WriteString(k)
+		b.WriteString("=")
+		b.WriteString(grouping[k])
+	}
+	return b.String()
+}
@@ -0,0 +1,49 @@
+package prometheus
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+const (
+	GoCollectorMetricsGC        = "gc"        // GC 相关的 runtime/metrics, 包括 GC 暂停时间直方图 /gc/pauses:seconds
+	GoCollectorMetricsMemory    = "memory"    // 按类别统计的内存 /memory/classes/...
+	GoCollectorMetricsScheduler = "scheduler" // 调度器相关的 runtime/metrics, 包括调度延迟直方图 /sched/latencies:seconds
+	GoCollectorMetricsAll       = "all"       // 所有 runtime/metrics
+)
+
+// 根据配置创建go收集器
+func newGoCollector(conf *Config) (prometheus.Collector, error) {
+	var rules []collectors.GoRuntimeMetricsRule
+	for _, name := range conf.GoCollectorMetrics {
+		switch strings.ToLower(name) {
+		case GoCollectorMetricsGC:
+			rules = append(rules, collectors.MetricsGC)
+		case GoCollectorMetricsMemory:
+			rules = append(rules, collectors.MetricsMemory)
+		case GoCollectorMetricsScheduler:
+			rules = append(rules, collectors.MetricsScheduler)
+		case GoCollectorMetricsAll:
+			rules = append(rules, collectors.MetricsAll)
+		default:
+			return nil, fmt.Errorf("unknown go collector metrics %q", name)
+		}
+	}
+	for _, expr := range conf.GoCollectorRules {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid go collector rule %q: %v", expr, err)
+		}
+		rules = append(rules, collectors.GoRuntimeMetricsRule{Matcher: re})
+	}
+
+	withRules := collectors.WithGoCollectorRuntimeMetrics(rules...)
+	if conf.GoCollectorDisableMemStats {
+		return collectors.NewGoCollector(withRules, collectors.WithGoCollectorMemStatsMetricsDisabled()), nil
+	}
+	return collectors.NewGoCollector(withRules), nil
+}
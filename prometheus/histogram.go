@@ -0,0 +1,94 @@
+package prometheus
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/zly-app/zapp/component/metrics"
+)
+
+// 原生直方图配置, 原生直方图按指数自动分桶, 无需为每个服务调整分桶.
+// pull模式需要通过 protobuf 格式拉取, RemoteWrite 需要使用 2.0 协议, 1.0 协议只会发送 _sum 和 _count.
+type NativeHistogramConfig struct {
+	BucketFactor     float64 // 相邻分桶上限的最大比例, 必须大于 1, 如: 1.1. 越接近 1 精度越高, 分桶越多
+	MaxBucketNumber  uint32  // 最大分桶数, 超出后降低精度, 0 表示不限制
+	MinResetDuration int64   // 分桶数超出后重置直方图的最小间隔, 单位毫秒, 0 表示不重置只降低精度
+	ZeroThreshold    float64 // 零桶阈值, 绝对值小于等于此值的观测值计入零桶, 0 表示使用默认值 2^-128, 负数表示只有 0 计入零桶
+}
+
+func (c *NativeHistogramConfig) check() error {
+	if c.BucketFactor <= 1 {
+		return fmt.Errorf("native histogram BucketFactor must be greater than 1, got %v", c.BucketFactor)
+	}
+	return nil
+}
+
+func (c *NativeHistogramConfig) apply(opts *prometheus.HistogramOpts) {
+	opts.NativeHistogramBucketFactor = c.BucketFactor
+	opts.NativeHistogramMaxBucketNumber = c.MaxBucketNumber
+	opts.NativeHistogramMinResetDuration = time.Duration(c.MinResetDuration) * time.Millisecond
+	opts.NativeHistogramZeroThreshold = c.ZeroThreshold
+}
+
+func (p *Client) RegistryNativeHistogram(name, help string, native NativeHistogramConfig, buckets []float64, constLabels metrics.Labels, labels ...string) metrics.IHistogram {
+	h, err := p.TryRegistryNativeHistogram(name, help, native, buckets, constLabels, labels...)
+	if err != nil {
+		p.app.Fatal("注册 metrics Histogram 原生直方图失败", zap.String("name", name), zap.Error(err))
+	}
+	return h
+}
+
+// 注册原生直方图, buckets 不为空时同时生成传统直方图的分桶. 重复注册的行为与 TryRegistryHistogram 一致
+func (p *Client) TryRegistryNativeHistogram(name, help string, native NativeHistogramConfig, buckets []float64, constLabels metrics.Labels, labels ...string) (metrics.IHistogram, error) {
+	if err := native.check(); err != nil {
+		return nil, fmt.Errorf("registry metrics Histogram %q err: %w", name, err)
+	}
+	return p.tryRegistryHistogram(name, help, buckets, &native, constLabels, labels...)
+}
+
+// 注册直方图, native 不为 nil 时启用原生直方图
+func (p *Client) tryRegistryHistogram(name, help string, buckets []float64, native *NativeHistogramConfig, constLabels metrics.Labels, labels ...string) (metrics.IHistogram, error) {
+	p.histogramCollectorLocker.Lock()
+	defer p.histogramCollectorLocker.Unlock()
+
+	if len(buckets) == 0 && native == nil {
+		buckets = prometheus.DefBuckets
+	}
+	sign := newMetricSignature(metricTypeHistogram, help, buckets, constLabels, labels)
+	if native != nil {
+		sign.opts = fmt.Sprintf("native%+v", *native)
+	}
+	err := p.claimMetricName(name, sign)
+	if err != nil {
+		return nil, err
+	}
+	if h, ok := p.histogramCollector[name]; ok {
+		return h, nil
+	}
+
+	opts := prometheus.HistogramOpts{
+		Namespace:   "",
+		Subsystem:   "",
+		Name:        name,
+		Help:        help,
+		ConstLabels: constLabels,
+		Buckets:     buckets,
+	}
+	if native != nil {
+		native.apply(&opts)
+	}
+	histogram := prometheus.NewHistogramVec(opts, labels)
+	err = p.registryCollector(histogram)
+	if err != nil {
+		p.releaseMetricName(name)
+		return nil, fmt.Errorf("registry metrics Histogram %q err: %w", name, err)
+	}
+
+	h := &histogramCli{series: newSeries(name, histogram.MetricVec), name: name, histogram: histogram}
+	p.addSeries(h.series)
+	p.histogramCollector[name] = h
+	return h, nil
+}
@@ -0,0 +1,179 @@
+package prometheus
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// http客户端配置, 用于 push 模式和 RemoteWrite 模式
+type HTTPClientConfig struct {
+	BasicAuthUser     string            // basic auth 用户名, 如果为空则不启用
+	BasicAuthPassword string            // basic auth 密码
+	BearerToken       string            // bearer token
+	BearerTokenFile   string            // bearer token 文件, 文件内容变化后自动重新读取, 优先于 BearerToken
+	Headers           map[string]string // 额外的请求头, 如: {"X-Scope-OrgID": "tenant"}
+
+	TLSCAFile             string // 用于校验服务端证书的 CA 证书文件
+	TLSCertFile           string // 客户端证书文件, 文件变化后自动重新加载
+	TLSKeyFile            string // 客户端私钥文件
+	TLSServerName         string // 服务端名称, 用于校验服务端证书
+	TLSInsecureSkipVerify bool   // 跳过服务端证书校验
+}
+
+// 创建http客户端
+func newHTTPClient(conf *HTTPClientConfig) (*http.Client, error) {
+	var defaultDialer = &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           defaultDialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	tlsConfig, err := newClientTLSConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{Transport: &authRoundTripper{conf: conf, next: transport}}, nil
+}
+
+func newClientTLSConfig(conf *HTTPClientConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         conf.TLSServerName,
+		InsecureSkipVerify: conf.TLSInsecureSkipVerify,
+	}
+	if conf.TLSCAFile != "" {
+		ca, err := os.ReadFile(conf.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ca file failed: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in ca file %s", conf.TLSCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if conf.TLSCertFile != "" || conf.TLSKeyFile != "" {
+		cert := newCertReloader(conf.TLSCertFile, conf.TLSKeyFile)
+		if _, err := cert.Get(); err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert.Get()
+		}
+	}
+	return tlsConfig, nil
+}
+
+// 为请求添加认证信息和额外的请求头
+type authRoundTripper struct {
+	conf *HTTPClientConfig
+	next http.RoundTripper
+
+	tokenFile fileCache
+}
+
+func (a *authRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for k, v := range a.conf.Headers {
+		req.Header.Set(k, v)
+	}
+
+	if a.conf.BasicAuthUser != "" {
+		req.SetBasicAuth(a.conf.BasicAuthUser, a.conf.BasicAuthPassword)
+	}
+
+	token := a.conf.BearerToken
+	if a.conf.BearerTokenFile != "" {
+		data, err := a.tokenFile.Read(a.conf.BearerTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("read bearer token file failed: %v", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return a.next.RoundTrip(req)
+}
+
+// 文件缓存, 文件修改时间或大小变化后重新读取
+type fileCache struct {
+	mx      sync.Mutex
+	modTime time.Time
+	size    int64
+	data    []byte
+}
+
+func (f *fileCache) Read(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	if f.data != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.data, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f.data, f.modTime, f.size = data, info.ModTime(), info.Size()
+	return data, nil
+}
+
+// 证书加载器, 证书或私钥文件变化后重新加载
+type certReloader struct {
+	certFile, keyFile string
+
+	mx              sync.Mutex
+	certMod, keyMod time.Time
+	cert            *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) *certReloader {
+	return &certReloader{certFile: certFile, keyFile: keyFile}
+}
+
+func (c *certReloader) Get() (*tls.Certificate, error) {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return nil, fmt.Errorf("stat cert file failed: %v", err)
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("stat key file failed: %v", err)
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.cert != nil && certInfo.ModTime().Equal(c.certMod) && keyInfo.ModTime().Equal(c.keyMod) {
+		return c.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil { // 证书可能正在替换中, 继续使用旧证书
+			return c.cert, nil
+		}
+		return nil, fmt.Errorf("load x509 key pair failed: %v", err)
+	}
+	c.cert, c.certMod, c.keyMod = &cert, certInfo.ModTime(), keyInfo.ModTime()
+	return c.cert, nil
+}
@@ -0,0 +1,313 @@
+package prometheus
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	io_prometheus_client "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+
+	"github.com/zly-app/zapp/core"
+)
+
+// InfluxDB 发送器
+//
+// 定时从收集器收集数据并转换为 InfluxDB 行协议, 通过 http(/api/v2/write) 或 UDP 发送.
+// 转换方式与 Telegraf 的 prometheus 输入(metric_version=1)一致, measurement 为指标名, 标签为 tag,
+// 计数器的值为 counter 字段, 计量器的值为 gauge 字段, 未知类型的值为 value 字段,
+// 汇总和直方图为 sum, count 字段以及以分位数或分桶上限为名称的字段.
+type influxSink struct {
+	app      core.IApp
+	conf     *Config
+	gatherer prometheus.Gatherer
+	tags     map[string]string // 附加的标签
+	metrics  *selfMetrics
+
+	client    *http.Client
+	url       string        // http 写入地址
+	udpConn   net.Conn      // UDP 连接, 使用 http 时为nil
+	precision time.Duration // 时间戳精度, http 为毫秒, UDP 为纳秒
+	target    string        // 自身指标的 target 标签, http 为 bucket, UDP 为地址
+}
+
+func newInfluxSink(app core.IApp, conf *Config, gatherer prometheus.Gatherer, tags map[string]string, metrics *selfMetrics) (*influxSink, error) {
+	s := &influxSink{
+		app:      app,
+		conf:     conf,
+		gatherer: gatherer,
+		tags:     tags,
+		metrics:  metrics,
+	}
+
+	// UDP 无法指定精度, 服务端默认按纳秒解析
+	if strings.HasPrefix(conf.InfluxAddress, "udp://") {
+		conn, err := net.Dial("udp", strings.TrimPrefix(conf.InfluxAddress, "udp://"))
+		if err != nil {
+			return nil, fmt.Errorf("dial influx udp err: %v", err)
+		}
+		s.udpConn = conn
+		s.precision = time.Nanosecond
+		s.target = strings.TrimPrefix(conf.InfluxAddress, "udp://")
+		return s, nil
+	}
+
+	address := conf.InfluxAddress
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	query := url.Values{}
+	query.Set("org", conf.InfluxOrg)
+	query.Set("bucket", conf.InfluxBucket)
+	query.Set("precision", "ms")
+	s.url = strings.TrimSuffix(address, "/") + "/api/v2/write?" + query.Encode()
+	s.precision = time.Millisecond
+	s.target = conf.InfluxBucket
+
+	client, err := newHTTPClient(&conf.InfluxHTTP)
+	if err != nil {
+		return nil, err
+	}
+	s.client = client
+	return s, nil
+}
+
+// 收集并发送一次数据
+func (s *influxSink) Write(ctx context.Context) error {
+	mfs, err := s.gatherer.Gather()
+	if err != nil && len(mfs) == 0 {
+		return err
+	}
+	lines, samples, series := s.lines(mfs, time.Now().UnixMilli())
+	if len(lines) == 0 {
+		return err
+	}
+	body := []byte(strings.Join(lines, "\n"))
+	s.metrics.observeWrite(exporterInflux, s.target, samples, series, len(body))
+
+	if s.udpConn != nil {
+		var sendErr error
+		splitPackets(lines, s.conf.InfluxMaxPacketSize, func(packet []byte) {
+			start := time.Now()
+			_, err := s.udpConn.Write(packet)
+			s.metrics.observeRequest(exporterInflux, s.target, start, len(packet), err)
+			if err != nil && sendErr == nil {
+				sendErr = err
+			}
+		})
+		if sendErr != nil {
+			return fmt.Errorf("send influx udp packet err: %v", sendErr)
+		}
+		return err
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, _ = gz.Write(body)
+	_ = gz.Close()
+	body = buf.Bytes()
+	if sendErr := s.send(ctx, body); sendErr != nil {
+		return sendErr
+	}
+	return err
+}
+
+func (s *influxSink) Close() error {
+	if s.udpConn != nil {
+		return s.udpConn.Close()
+	}
+	return nil
+}
+
+// 发送请求, 可重试的错误按指数退避重试, 重试配置与 RemoteWrite 模式一致
+func (s *influxSink) send(ctx context.Context, body []byte) error {
+	backoff := time.Duration(s.conf.WriteRetryInterval) * time.Millisecond
+	maxBackoff := time.Duration(s.conf.WriteRetryMaxInterval) * time.Millisecond
+	for attempt := uint32(0); ; attempt++ {
+		start := time.Now()
+		err := s.post(ctx, body)
+		s.metrics.observeRequest(exporterInflux, s.target, start, len(body), err)
+		if err == nil {
+			return nil
+		}
+		var writeErr *RemoteWriteError
+		if !errors.As(err, &writeErr) || !writeErr.Recoverable || attempt >= s.conf.WriteRetry || ctx.Err() != nil {
+			return err
+		}
+
+		wait := backoff
+		if writeErr.RetryAfter > 0 {
+			wait = writeErr.RetryAfter
+		}
+		s.app.Warn("metrics InfluxDB 写入失败, 等待重试", zap.Uint32("attempt", attempt+1), zap.Duration("wait", wait), zap.Error(err))
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (s *influxSink) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.conf.InfluxToken != "" {
+		req.Header.Set("Authorization", "Token "+s.conf.InfluxToken)
+	}
+	req.Header.Set("Content-Encoding", "gzip")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return &RemoteWriteError{Url: s.url, Recoverable: true, Err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &RemoteWriteError{
+			Url:         s.url,
+			StatusCode:  resp.StatusCode,
+			Recoverable: resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests,
+			RetryAfter:  parseRetryAfter(resp.Header.Get("Retry-After")),
+			Err:         fmt.Errorf("unexpected status code %d while writing to %s: %s", resp.StatusCode, s.url, msg),
+		}
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// 生成行协议数据, samples 为字段数, series 为不同的 measurement 和标签组合数
+func (s *influxSink) lines(mfs []*io_prometheus_client.MetricFamily, now int64) (lines []string, samples, series int) {
+	lines = make([]string, 0, len(mfs))
+	seen := make(map[string]struct{}, len(mfs))
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			t := now
+			if m.GetTimestampMs() > 0 {
+				t = m.GetTimestampMs()
+			}
+
+			fields := make(map[string]float64, 2)
+			switch mf.GetType() {
+			case io_prometheus_client.MetricType_COUNTER:
+				fields["counter"] = m.GetCounter().GetValue()
+			case io_prometheus_client.MetricType_GAUGE:
+				fields["gauge"] = m.GetGauge().GetValue()
+			case io_prometheus_client.MetricType_UNTYPED:
+				fields["value"] = m.GetUntyped().GetValue()
+			case io_prometheus_client.MetricType_SUMMARY:
+				summary := m.GetSummary()
+				for _, q := range summary.GetQuantile() {
+					fields[formatFloat(q.GetQuantile())] = q.GetValue()
+				}
+				fields["sum"] = summary.GetSampleSum()
+				fields["count"] = float64(summary.GetSampleCount())
+			case io_prometheus_client.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					v := float64(b.GetCumulativeCount())
+					if b.GetCumulativeCountFloat() > 0 {
+						v = b.GetCumulativeCountFloat()
+					}
+					fields[formatFloat(b.GetUpperBound())] = v
+				}
+				fields["sum"] = h.GetSampleSum()
+				fields["count"] = float64(h.GetSampleCount())
+				if h.GetSampleCountFloat() > 0 {
+					fields["count"] = h.GetSampleCountFloat()
+				}
+			}
+			line, key, n := s.line(mf.GetName(), m.GetLabel(), fields, t)
+			if n == 0 {
+				continue
+			}
+			lines = append(lines, line)
+			samples += n
+			if _, ok := seen[key]; !ok {
+				seen[key] = struct{}{}
+				series++
+			}
+		}
+	}
+	return lines, samples, series
+}
+
+// 生成一行数据, t 为毫秒时间戳, 按发送器的精度写入. key 为 measurement 和标签部分, n 为有效的字段数, 没有有效的字段时为 0
+func (s *influxSink) line(name string, labels []*io_prometheus_client.LabelPair, fields map[string]float64, t int64) (line, key string, n int) {
+	fieldKeys := make([]string, 0, len(fields))
+	for k, v := range fields {
+		if math.IsNaN(v) || math.IsInf(v, 0) { // 行协议不支持
+			continue
+		}
+		fieldKeys = append(fieldKeys, k)
+	}
+	if len(fieldKeys) == 0 {
+		return "", "", 0
+	}
+	sort.Strings(fieldKeys)
+
+	tags := make(map[string]string, len(s.tags)+len(labels))
+	for k, v := range s.tags {
+		tags[k] = v
+	}
+	for _, l := range labels {
+		tags[l.GetName()] = l.GetValue()
+	}
+	tagKeys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if v == "" {
+			continue
+		}
+		tagKeys = append(tagKeys, k)
+	}
+	sort.Strings(tagKeys)
+
+	var sb strings.Builder
+	sb.WriteString(influxMeasurementEscaper.Replace(name))
+	for _, k := range tagKeys {
+		sb.WriteByte(',')
+		sb.WriteString(influxTagEscaper.Replace(k))
+		sb.WriteByte('=')
+		sb.WriteString(influxTagEscaper.Replace(tags[k]))
+	}
+	key = sb.String()
+	for i, k := range fieldKeys {
+		if i == 0 {
+			sb.WriteByte(' ')
+		} else {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(influxTagEscaper.Replace(k))
+		sb.WriteByte('=')
+		sb.WriteString(strconv.FormatFloat(fields[k], 'f', -1, 64))
+	}
+	sb.WriteByte(' ')
+	sb.WriteString(strconv.FormatInt(t*int64(time.Millisecond/s.precision), 10))
+	return sb.String(), key, len(fieldKeys)
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`, "\n", `\n`)
+)
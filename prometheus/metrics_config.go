@@ -0,0 +1,73 @@
+package prometheus
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	MetricTypeCounter   = "counter"
+	MetricTypeGauge     = "gauge"
+	MetricTypeHistogram = "histogram"
+	MetricTypeSummary   = "summary"
+)
+
+// 在配置中声明的指标, 在 NewClient 时注册, 代码中通过 Counter, Gauge, Histogram, Summary 获取
+//
+// 代码中重复注册同名指标时只检查类型和标签, 描述, 常量标签, 分桶和分位数以配置为准.
+type MetricConfig struct {
+	Name        string            // 指标名
+	Type        string            // 类型, 可选 counter, gauge, histogram, summary
+	Help        string            // 描述
+	Labels      []string          // 标签名
+	ConstLabels map[string]string // 常量标签, 如: {"cluster": "sh"}
+
+	Buckets         []float64              // 直方图分桶, 为空且未启用原生直方图时使用默认分桶
+	NativeHistogram *NativeHistogramConfig // 直方图同时启用原生直方图, 为空时使用 NativeHistograms 中的配置
+
+	Objectives []SummaryObjective // 汇总的分位数及其允许的误差, 为空时使用 Summaries 中的配置或默认分位数
+	MaxAge     int64              // 汇总观测值的保留时间, 单位毫秒
+	AgeBuckets uint32             // 汇总保留时间内滑动窗口的桶数
+}
+
+// 注册配置中声明的指标
+func (p *Client) registryDeclaredMetrics(confs []MetricConfig) error {
+	for i, conf := range confs {
+		if conf.Name == "" {
+			return fmt.Errorf("metrics config %d: Name is required", i)
+		}
+
+		var err error
+		switch strings.ToLower(conf.Type) {
+		case MetricTypeCounter:
+			_, err = p.TryRegistryCounter(conf.Name, conf.Help, conf.ConstLabels, conf.Labels...)
+		case MetricTypeGauge:
+			_, err = p.TryRegistryGauge(conf.Name, conf.Help, conf.ConstLabels, conf.Labels...)
+		case MetricTypeHistogram:
+			if conf.NativeHistogram != nil {
+				_, err = p.TryRegistryNativeHistogram(conf.Name, conf.Help, *conf.NativeHistogram, conf.Buckets, conf.ConstLabels, conf.Labels...)
+			} else {
+				_, err = p.TryRegistryHistogram(conf.Name, conf.Help, conf.Buckets, conf.ConstLabels, conf.Labels...)
+			}
+		case MetricTypeSummary:
+			summary := p.conf.Summaries[conf.Name]
+			if len(conf.Objectives) > 0 {
+				summary.Objectives = conf.Objectives
+			}
+			if conf.MaxAge > 0 {
+				summary.MaxAge = conf.MaxAge
+			}
+			if conf.AgeBuckets > 0 {
+				summary.AgeBuckets = conf.AgeBuckets
+			}
+			_, err = p.TryRegistrySummaryWithConfig(conf.Name, conf.Help, summary, conf.ConstLabels, conf.Labels...)
+		default:
+			return fmt.Errorf("metrics config %q: unknown type %q", conf.Name, conf.Type)
+		}
+		if err != nil {
+			return fmt.Errorf("metrics config %q: %w", conf.Name, err)
+		}
+		p.markMetricDeclared(conf.Name)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package prometheus
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/zly-app/zapp/core"
+)
+
+const (
+	pullHealthyPath = "/-/healthy"
+	pullReadyPath   = "/-/ready"
+)
+
+// 可以挂载 http.Handler 的服务, pull模式通过 PullService 挂载到实现了此接口的 zapp 服务上
+type HandlerMounter interface {
+	Handle(pattern string, handler http.Handler)
+}
+
+// 获取 pull模式 metrics handler, 已包含访问控制, 可以挂载到已有的 http 服务上
+func (p *Client) Handler() http.Handler {
+	return p.pullHandler
+}
+
+// 存活检查
+func (p *Client) healthy(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("Healthy.\n"))
+}
+
+// 就绪检查, 启动完成后才返回成功
+func (p *Client) readiness(w http.ResponseWriter, r *http.Request) {
+	if !p.ready.Load() {
+		http.Error(w, "Not ready.", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("Ready.\n"))
+}
+
+// 注册到单独端口的服务上, 包括检查接口
+func (p *Client) registerPullHandlers(conf *Config, mux HandlerMounter) {
+	mux.Handle(conf.PullPath, p.pullHandler)
+	mux.Handle(pullHealthyPath, http.HandlerFunc(p.healthy))
+	mux.Handle(pullReadyPath, http.HandlerFunc(p.readiness))
+}
+
+// 挂载到已有的 zapp 服务上, 只挂载 PullPath, 服务可能已有同名的检查接口
+func (p *Client) mountPullHandler(conf *Config) error {
+	service, ok := p.app.GetService(core.ServiceType(conf.PullService))
+	if !ok {
+		return fmt.Errorf("metrics pull service %q not found", conf.PullService)
+	}
+	mux, ok := service.(HandlerMounter)
+	if !ok {
+		return fmt.Errorf("metrics pull service %q can not mount http.Handler", conf.PullService)
+	}
+	mux.Handle(conf.PullPath, p.pullHandler)
+	return nil
+}
+
+// pull模式访问控制
+type pullGuard struct {
+	allowNets []*net.IPNet
+
+	basicAuthUser, basicAuthPassword string
+	bearerToken                      string
+}
+
+func newPullGuard(conf *Config) (*pullGuard, error) {
+	g := &pullGuard{
+		basicAuthUser:     conf.PullBasicAuthUser,
+		basicAuthPassword: conf.PullBasicAuthPassword,
+		bearerToken:       conf.PullBearerToken,
+	}
+	for _, cidr := range conf.PullAllowCIDRs {
+		if !strings.Contains(cidr, "/") { // 单个ip
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PullAllowCIDRs %q: %v", cidr, err)
+		}
+		g.allowNets = append(g.allowNets, ipNet)
+	}
+	return g, nil
+}
+
+// 检查访问权限, 不通过时写入错误响应并返回 false
+func (g *pullGuard) check(w http.ResponseWriter, r *http.Request) bool {
+	if !g.allowIP(r.RemoteAddr) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return false
+	}
+	if !g.authorized(r) {
+		if g.basicAuthUser != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+		}
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// 访问控制可以在配置热更新时替换的 handler
+type reloadableGuardHandler struct {
+	guard atomic.Pointer[pullGuard]
+	next  http.Handler
+}
+
+func newReloadableGuardHandler(guard *pullGuard, next http.Handler) *reloadableGuardHandler {
+	h := &reloadableGuardHandler{next: next}
+	h.guard.Store(guard)
+	return h
+}
+
+func (h *reloadableGuardHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.guard.Load().check(w, r) {
+		h.next.ServeHTTP(w, r)
+	}
+}
+
+func (g *pullGuard) allowIP(remoteAddr string) bool {
+	if len(g.allowNets) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range g.allowNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 同时配置了 basic auth 和 bearer token 时满足其一即可
+func (g *pullGuard) authorized(r *http.Request) bool {
+	if g.basicAuthUser == "" && g.bearerToken == "" {
+		return true
+	}
+	if g.basicAuthUser != "" {
+		user, password, ok := r.BasicAuth()
+		if ok && secureEqual(user, g.basicAuthUser) && secureEqual(password, g.basicAuthPassword) {
+			return true
+		}
+	}
+	if g.bearerToken != "" {
+		auth := r.Header.Get("Authorization")
+		if strings.HasPrefix(auth, "Bearer ") && secureEqual(strings.TrimPrefix(auth, "Bearer "), g.bearerToken) {
+			return true
+		}
+	}
+	return false
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// pull模式 TLS 配置, 证书或私钥文件变化后自动重新加载
+func newPullTLSConfig(conf *Config) (*tls.Config, error) {
+	if conf.PullTLSCertFile == "" && conf.PullTLSKeyFile == "" {
+		return nil, nil
+	}
+	cert := newCertReloader(conf.PullTLSCertFile, conf.PullTLSKeyFile)
+	if _, err := cert.Get(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return cert.Get()
+		},
+	}, nil
+}
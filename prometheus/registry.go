@@ -0,0 +1,129 @@
+package prometheus
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/zly-app/zapp/component/metrics"
+)
+
+const (
+	metricTypeCounter   = "Counter"
+	metricTypeGauge     = "Gauge"
+	metricTypeHistogram = "Histogram"
+	metricTypeSummary   = "Summary"
+)
+
+// 指标注册冲突, 同名指标已注册且签名(类型, 描述, 标签, 分桶, 其它选项)不一致
+type RegistryConflictError struct {
+	Name         string // 指标名
+	Type         string // 注册的指标类型
+	ExistingType string // 已注册的指标类型
+	Reason       string // 冲突原因
+}
+
+func (e *RegistryConflictError) Error() string {
+	return fmt.Sprintf("metrics %s %q conflicts with registered %s: %s", e.Type, e.Name, e.ExistingType, e.Reason)
+}
+
+// 指标签名, 签名一致时重复注册返回已注册的指标
+type metricSignature struct {
+	typ         string
+	help        string
+	constLabels metrics.Labels
+	labels      []string
+	buckets     []float64
+	opts        string // 其它选项, 如原生直方图配置
+	declared    bool   // 是否为配置中声明的指标
+}
+
+func newMetricSignature(typ, help string, buckets []float64, constLabels metrics.Labels, labels []string) *metricSignature {
+	sortedLabels := append([]string(nil), labels...)
+	sort.Strings(sortedLabels)
+	return &metricSignature{
+		typ:         typ,
+		help:        help,
+		constLabels: constLabels,
+		labels:      sortedLabels,
+		buckets:     append([]float64(nil), buckets...),
+	}
+}
+
+// 检查重复注册的签名是否一致. 配置中声明的指标只检查类型和标签, 其它以配置为准
+func (s *metricSignature) check(name string, o *metricSignature) error {
+	reason := ""
+	switch {
+	case s.typ != o.typ:
+		reason = "type differs"
+	case s.declared && strings.Join(s.labels, ",") != strings.Join(o.labels, ","):
+		reason = fmt.Sprintf("labels differ from declared metric: %v != %v", o.labels, s.labels)
+	case s.declared:
+		return nil
+	case s.help != o.help:
+		reason = fmt.Sprintf("help differs: %q != %q", o.help, s.help)
+	case !equalLabels(s.constLabels, o.constLabels):
+		reason = fmt.Sprintf("const labels differ: %v != %v", o.constLabels, s.constLabels)
+	case strings.Join(s.labels, ",") != strings.Join(o.labels, ","):
+		reason = fmt.Sprintf("labels differ: %v != %v", o.labels, s.labels)
+	case !equalBuckets(s.buckets, o.buckets):
+		reason = fmt.Sprintf("buckets differ: %v != %v", o.buckets, s.buckets)
+	case s.opts != o.opts:
+		reason = fmt.Sprintf("options differ: %s != %s", o.opts, s.opts)
+	default:
+		return nil
+	}
+	return &RegistryConflictError{Name: name, Type: o.typ, ExistingType: s.typ, Reason: reason}
+}
+
+func equalLabels(a, b metrics.Labels) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+func equalBuckets(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// 占用指标名, 不同类型的指标不能同名
+func (p *Client) claimMetricName(name string, sign *metricSignature) error {
+	p.signaturesLocker.Lock()
+	defer p.signaturesLocker.Unlock()
+
+	if s, ok := p.signatures[name]; ok {
+		return s.check(name, sign)
+	}
+	p.signatures[name] = sign
+	return nil
+}
+
+// 标记为配置中声明的指标
+func (p *Client) markMetricDeclared(name string) {
+	p.signaturesLocker.Lock()
+	defer p.signaturesLocker.Unlock()
+	if s, ok := p.signatures[name]; ok {
+		s.declared = true
+	}
+}
+
+// 释放指标名, 用于注册失败时
+func (p *Client) releaseMetricName(name string) {
+	p.signaturesLocker.Lock()
+	defer p.signaturesLocker.Unlock()
+	delete(p.signatures, name)
+}
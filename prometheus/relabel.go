@@ -0,0 +1,218 @@
+package prometheus
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	io_prometheus_client "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	RelabelActionReplace   = "replace"   // 源标签的值匹配 Regex 时将 Replacement 展开后写入 TargetLabel, 结果为空时删除 TargetLabel
+	RelabelActionKeep      = "keep"      // 只保留源标签的值匹配 Regex 的时间序列
+	RelabelActionDrop      = "drop"      // 丢弃源标签的值匹配 Regex 的时间序列
+	RelabelActionLabelDrop = "labeldrop" // 删除名称匹配 Regex 的标签
+	RelabelActionLabelKeep = "labelkeep" // 只保留名称匹配 Regex 的标签
+)
+
+const (
+	defaultRelabelSeparator   = ";"
+	defaultRelabelRegex       = "(.*)"
+	defaultRelabelReplacement = "$1"
+)
+
+// 重新标记配置, 与 Prometheus 的 metric_relabel_configs 一致, 指标名为 __name__ 标签
+type RelabelConfig struct {
+	SourceLabels []string // 源标签, 值按 Separator 拼接后与 Regex 匹配
+	Separator    string   // 源标签的值的分隔符, 默认为 ;
+	Regex        string   // 正则表达式, 会自动添加 ^ 和 $, 默认为 (.*)
+	TargetLabel  string   // replace 写入的标签
+	Replacement  string   // replace 写入的值, 可以引用 Regex 的分组, 默认为 $1
+	Action       string   // 动作, 可选 replace, keep, drop, labeldrop, labelkeep, 默认为 replace
+}
+
+type relabelRule struct {
+	RelabelConfig
+	regex *regexp.Regexp
+}
+
+func newRelabelRules(confs []RelabelConfig) ([]*relabelRule, error) {
+	rules := make([]*relabelRule, 0, len(confs))
+	for i, conf := range confs {
+		if conf.Separator == "" {
+			conf.Separator = defaultRelabelSeparator
+		}
+		if conf.Regex == "" {
+			conf.Regex = defaultRelabelRegex
+		}
+		if conf.Replacement == "" {
+			conf.Replacement = defaultRelabelReplacement
+		}
+		if conf.Action == "" {
+			conf.Action = RelabelActionReplace
+		}
+		conf.Action = strings.ToLower(conf.Action)
+
+		switch conf.Action {
+		case RelabelActionReplace:
+			if conf.TargetLabel == "" {
+				return nil, fmt.Errorf("relabel config %d: TargetLabel is required for action replace", i)
+			}
+		case RelabelActionKeep, RelabelActionDrop:
+			if len(conf.SourceLabels) == 0 {
+				return nil, fmt.Errorf("relabel config %d: SourceLabels is required for action %s", i, conf.Action)
+			}
+		case RelabelActionLabelDrop, RelabelActionLabelKeep:
+		default:
+			return nil, fmt.Errorf("relabel config %d: unknown action %q", i, conf.Action)
+		}
+
+		regex, err := regexp.Compile("^(?:" + conf.Regex + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("relabel config %d: invalid regex %q: %v", i, conf.Regex, err)
+		}
+		rules = append(rules, &relabelRule{RelabelConfig: conf, regex: regex})
+	}
+	return rules, nil
+}
+
+// 按顺序应用规则, 返回 false 表示丢弃
+func relabel(labels map[string]string, rules []*relabelRule) bool {
+	for _, r := range rules {
+		switch r.Action {
+		case RelabelActionLabelDrop:
+			for k := range labels {
+				if k != "__name__" && r.regex.MatchString(k) {
+					delete(labels, k)
+				}
+			}
+			continue
+		case RelabelActionLabelKeep:
+			for k := range labels {
+				if k != "__name__" && !r.regex.MatchString(k) {
+					delete(labels, k)
+				}
+			}
+			continue
+		}
+
+		values := make([]string, len(r.SourceLabels))
+		for i, name := range r.SourceLabels {
+			values[i] = labels[name]
+		}
+		value := strings.Join(values, r.Separator)
+
+		switch r.Action {
+		case RelabelActionKeep:
+			if !r.regex.MatchString(value) {
+				return false
+			}
+		case RelabelActionDrop:
+			if r.regex.MatchString(value) {
+				return false
+			}
+		case RelabelActionReplace:
+			indexes := r.regex.FindStringSubmatchIndex(value)
+			if indexes == nil {
+				continue
+			}
+			target := string(r.regex.ExpandString(nil, r.TargetLabel, value, indexes))
+			result := string(r.regex.ExpandString(nil, r.Replacement, value, indexes))
+			if result == "" {
+				delete(labels, target)
+				continue
+			}
+			labels[target] = result
+		}
+	}
+	return labels["__name__"] != ""
+}
+
+// 收集时应用重新标记规则的收集器
+//
+// 重新标记前先加入附加的标签, 不会覆盖指标已有的标签. 重新标记后指标名和标签都相同的时间序列只保留第一个.
+type relabelGatherer struct {
+	gatherer prometheus.Gatherer
+	rules    []*relabelRule
+	external map[string]string // 附加的标签
+}
+
+func newRelabelGatherer(gatherer prometheus.Gatherer, rules []*relabelRule, external map[string]string) prometheus.Gatherer {
+	if len(rules) == 0 && len(external) == 0 {
+		return gatherer
+	}
+	return &relabelGatherer{gatherer: gatherer, rules: rules, external: external}
+}
+
+func (g *relabelGatherer) Gather() ([]*io_prometheus_client.MetricFamily, error) {
+	mfs, err := g.gatherer.Gather()
+
+	families := make(map[string]*io_prometheus_client.MetricFamily, len(mfs))
+	seen := make(map[string]struct{})
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string, len(m.GetLabel())+len(g.external)+1)
+			for k, v := range g.external {
+				labels[k] = v
+			}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			labels["__name__"] = mf.GetName()
+			if !relabel(labels, g.rules) {
+				continue
+			}
+
+			name := labels["__name__"]
+			delete(labels, "__name__")
+			pairs := make([]*io_prometheus_client.LabelPair, 0, len(labels))
+			for k, v := range labels {
+				pairs = append(pairs, &io_prometheus_client.LabelPair{Name: proto.String(k), Value: proto.String(v)})
+			}
+			sort.Slice(pairs, func(i, j int) bool { return pairs[i].GetName() < pairs[j].GetName() })
+
+			key := name + "\xff" + labelPairsKey(pairs)
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+
+			family, ok := families[name]
+			if !ok {
+				family = &io_prometheus_client.MetricFamily{Name: proto.String(name), Help: mf.Help, Type: mf.Type, Unit: mf.Unit}
+				families[name] = family
+			}
+			family.Metric = append(family.Metric, &io_prometheus_client.Metric{
+				Label:       pairs,
+				Gauge:       m.Gauge,
+				Counter:     m.Counter,
+				Summary:     m.Summary,
+				Untyped:     m.Untyped,
+				Histogram:   m.Histogram,
+				TimestampMs: m.TimestampMs,
+			})
+		}
+	}
+
+	ret := make([]*io_prometheus_client.MetricFamily, 0, len(families))
+	for _, family := range families {
+		ret = append(ret, family)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].GetName() < ret[j].GetName() })
+	return ret, err
+}
+
+func labelPairsKey(pairs []*io_prometheus_client.LabelPair) string {
+	var sb strings.Builder
+	for _, l := range pairs {
+		sb.WriteString(l.GetName())
+		sb.WriteByte(0xff)
+		sb.WriteString(l.GetValue())
+		sb.WriteByte(0xff)
+	}
+	return sb.String()
+}
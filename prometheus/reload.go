@@ -0,0 +1,131 @@
+package prometheus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+
+	"github.com/zly-app/zapp/config"
+)
+
+var errClientNotRunning = errors.New("metrics client is not running")
+
+// 热更新配置, 按新的配置重建 push模式, RemoteWrite 模式, StatsD 模式和 InfluxDB 模式的发送器, 并替换 pull模式的访问控制
+//
+// 其它配置(如收集器, pull模式地址, 时间序列限制和声明的指标)需要重启后生效.
+// 先按新的配置创建发送器并打开预写日志, 新的配置有误时返回错误并保留原来的发送器;
+// 成功后停止原来的发送器, 在 CloseTimeout 内完成最后一次推送和写入, push模式的分组变化时删除原来的分组, 再启动新的发送器.
+// 只能在启动后调用.
+func (p *Client) Reload(conf *Config) error {
+	conf.Check()
+	guard, err := newPullGuard(conf)
+	if err != nil {
+		return fmt.Errorf("metrics pull guard config err: %v", err)
+	}
+
+	p.exportersMx.Lock()
+	defer p.exportersMx.Unlock()
+	if !p.ready.Load() {
+		return errClientNotRunning
+	}
+
+	// 先按新的配置创建发送器, 配置有误时原来的发送器不受影响
+	e, err := p.prepareExporters(conf)
+	if err != nil {
+		return err
+	}
+	old := p.exporters
+	if err = p.openExporters(e, old); err != nil {
+		_ = p.stopExporters(context.Background(), e, false)
+		return err
+	}
+
+	if old != nil {
+		// 分组变化时原来的分组不再推送, 不删除会一直保留在 Pushgateway 中; 分组不变时只推送最后一次
+		old.deletePushGroup = old.pusher != nil && old.pushGroup != e.pushGroup
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(old.conf.CloseTimeout)*time.Millisecond)
+		for _, err := range p.stopExporters(ctx, old, true) {
+			p.app.Error("metrics 热更新停止原来的发送器失败", zap.Error(err))
+		}
+		cancel()
+	}
+	// 复用的预写日志中可能有原来的发送器按原来的分片数写入的数据, 需要先按顺序重放
+	for _, t := range e.writeTargets {
+		if t.queue.wal != nil {
+			t.queue.wal.resetShards()
+		}
+	}
+	p.exporters = e
+	p.startExporters(e)
+	p.pullHandler.guard.Store(guard)
+
+	// 删除已移除的目标的指标
+	if old != nil {
+		targets := make(map[[2]string]struct{})
+		for _, t := range e.selfMetricsTargets() {
+			targets[t] = struct{}{}
+		}
+		for _, t := range old.selfMetricsTargets() {
+			if _, ok := targets[t]; !ok {
+				p.selfMetrics.deleteTarget(t[0], t[1])
+			}
+		}
+	}
+	return nil
+}
+
+// 监听配置变化并热更新
+//
+// 配置监听没有取消的接口, 关闭后回调不再生效.
+func (p *Client) startWatchConfig(conf *Config) {
+	if conf.WatchGroup == "" || conf.WatchKey == "" {
+		return
+	}
+
+	w := config.WatchKey(conf.WatchGroup, conf.WatchKey)
+	w.AddCallback(func(first bool, oldData, newData []byte) {
+		if len(newData) == 0 || !p.ready.Load() { // 未设置或已关闭
+			return
+		}
+		start := time.Now()
+		newConf, err := parseWatchConfig(newData)
+		if err != nil {
+			p.app.Error("解析 metrics 热更新配置失败", zap.String("WatchGroup", conf.WatchGroup), zap.String("WatchKey", conf.WatchKey), zap.Error(err))
+			return
+		}
+		if err = p.Reload(newConf); errors.Is(err, errClientNotRunning) { // 热更新时已关闭
+			return
+		} else if err != nil {
+			p.app.Error("metrics 热更新配置失败", zap.String("WatchGroup", conf.WatchGroup), zap.String("WatchKey", conf.WatchKey), zap.Error(err))
+			return
+		}
+		p.app.Info("metrics 热更新配置完成", zap.Bool("first", first), zap.Duration("duration", time.Since(start)))
+	})
+	p.app.Info("启用 metrics 配置热更新", zap.String("WatchGroup", conf.WatchGroup), zap.String("WatchKey", conf.WatchKey))
+}
+
+// 解析 yaml 格式的配置, 字段名不区分大小写, 与配置文件的解析方式一致
+func parseWatchConfig(data []byte) (*Config, error) {
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("unmarshal yaml err: %v", err)
+	}
+
+	conf := newConfig()
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		WeaklyTypedInput: true,
+		Result:           conf,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = decoder.Decode(raw); err != nil {
+		return nil, fmt.Errorf("decode config err: %v", err)
+	}
+	return conf, nil
+}
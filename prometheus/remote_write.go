@@ -2,10 +2,14 @@ package prometheus
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"math"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -32,10 +36,11 @@ type RemoteWrite struct {
 	useBasicAuth       bool
 	username, password string
 
-	expfmt     expfmt.Format
-	expfmtType expfmt.FormatType
-	labels     map[string]string
-	snappyBuf  *bytes.Buffer
+	expfmt          expfmt.Format
+	expfmtType      expfmt.FormatType
+	protocolVersion string
+	labels          map[string]string
+	snappyBuf       *bytes.Buffer
 }
 
 func NewRemoteWrite(url string) *RemoteWrite {
@@ -49,13 +54,14 @@ func NewRemoteWrite(url string) *RemoteWrite {
 	url = strings.TrimSuffix(url, "/")
 
 	return &RemoteWrite{
-		url:        url,
-		gatherers:  prometheus.Gatherers{reg},
-		registerer: reg,
-		client:     &http.Client{},
-		expfmt:     expfmt.NewFormat(expfmt.TypeProtoDelim),
-		expfmtType: expfmt.TypeProtoDelim,
-		labels:     map[string]string{},
+		url:             url,
+		gatherers:       prometheus.Gatherers{reg},
+		registerer:      reg,
+		client:          &http.Client{},
+		expfmt:          expfmt.NewFormat(expfmt.TypeProtoDelim),
+		expfmtType:      expfmt.TypeProtoDelim,
+		protocolVersion: RemoteWriteProtocolV1,
+		labels:          map[string]string{},
 	}
 }
 
@@ -69,6 +75,12 @@ func (p *RemoteWrite) FormatType(t expfmt.FormatType) *RemoteWrite {
 	return p
 }
 
+// 设置协议版本, 可选 RemoteWriteProtocolV1, RemoteWriteProtocolV2
+func (p *RemoteWrite) ProtocolVersion(v string) *RemoteWrite {
+	p.protocolVersion = v
+	return p
+}
+
 func (p *RemoteWrite) BasicAuth(username, password string) *RemoteWrite {
 	p.useBasicAuth = true
 	p.username = username
@@ -91,35 +103,65 @@ func (p *RemoteWrite) Add() error {
 }
 
 func (p *RemoteWrite) PushLocal() error {
-	return p.push(http.MethodPost)
+	return p.pushLocal(http.MethodPost)
 }
 
 func (p *RemoteWrite) AddLocal() error {
-	return p.push(http.MethodPut)
+	return p.pushLocal(http.MethodPut)
+}
+
+// 获取 Collect 收集后经过 snappy 压缩的请求体
+func (p *RemoteWrite) Payload() []byte {
+	if p.snappyBuf == nil {
+		return nil
+	}
+	return p.snappyBuf.Bytes()
+}
+
+// 推送指定协议版本的请求体, 一般用于重放预写日志中的数据
+func (p *RemoteWrite) PushPayload(ctx context.Context, protocolVersion string, body []byte) error {
+	return p.push(ctx, http.MethodPost, protocolVersion, body)
 }
 
 func (p *RemoteWrite) Collect() error {
 	if p.error != nil {
 		return p.error
 	}
-	wr, err := p.toPromWriteRequest()
+	data, err := p.marshal()
 	if err != nil {
 		return err
 	}
-	data, err := proto.Marshal(wr)
-	if err != nil {
-		return fmt.Errorf("unable to marshal protobuf: %v", err)
-	}
 
 	p.snappyBuf = &bytes.Buffer{}
 	p.snappyBuf.Write(snappy.Encode(nil, data))
 	return nil
 }
 
-//func (p *RemoteWrite) Gatherer(g prometheus.Gatherer) *RemoteWrite {
-//	p.gatherers = append(p.gatherers, g)
-//	return p
-//}
+func (p *RemoteWrite) marshal() ([]byte, error) {
+	if p.protocolVersion == RemoteWriteProtocolV2 {
+		wr, err := p.toWriteV2Request()
+		if err != nil {
+			return nil, err
+		}
+		return wr.Marshal(), nil
+	}
+
+	wr, err := p.toPromWriteRequest()
+	if err != nil {
+		return nil, err
+	}
+	data, err := proto.Marshal(wr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal protobuf: %v", err)
+	}
+	return data, nil
+}
+
+// 添加收集器, 收集时会同时从这个收集器收集数据
+func (p *RemoteWrite) Gatherer(g prometheus.Gatherer) *RemoteWrite {
+	p.gatherers = append(p.gatherers, g)
+	return p
+}
 
 func (p *RemoteWrite) ExtraLabel(key, values string) *RemoteWrite {
 	p.labels[key] = values
@@ -133,12 +175,15 @@ func (p *RemoteWrite) Collector(c prometheus.Collector) *RemoteWrite {
 	return p
 }
 
-func (p *RemoteWrite) push(method string) error {
+func (p *RemoteWrite) pushLocal(method string) error {
 	if p.snappyBuf == nil || p.snappyBuf.Len() == 0 {
 		return fmt.Errorf("empty snappy buf")
 	}
+	return p.push(context.Background(), method, p.protocolVersion, p.snappyBuf.Bytes())
+}
 
-	req, err := http.NewRequest(method, p.url, p.snappyBuf)
+func (p *RemoteWrite) push(ctx context.Context, method string, protocolVersion string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, method, p.url, bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
@@ -147,23 +192,164 @@ func (p *RemoteWrite) push(method string) error {
 		req.SetBasicAuth(p.username, p.password)
 	}
 
-	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
-	req.Header.Set("Content-Type", "application/x-protobuf")
+	if protocolVersion == RemoteWriteProtocolV2 {
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "2.0.0")
+		req.Header.Set("Content-Type", writeV2ContentType)
+	} else {
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+		req.Header.Set("Content-Type", "application/x-protobuf")
+	}
 	req.Header.Set("Content-Encoding", "snappy")
 
 	resp, err := p.client.Do(req)
 	if err != nil {
-		return err
+		return &RemoteWriteError{Url: p.url, Recoverable: true, Err: err}
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode < 200 && resp.StatusCode > 299 {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("unexpected status code %d while pushing to %s: %s", resp.StatusCode, p.url, body)
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &RemoteWriteError{
+			Url:         p.url,
+			StatusCode:  resp.StatusCode,
+			Recoverable: resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests,
+			RetryAfter:  parseRetryAfter(resp.Header.Get("Retry-After")),
+			Err:         fmt.Errorf("unexpected status code %d while pushing to %s: %s", resp.StatusCode, p.url, body),
+		}
 	}
-
+	_, _ = io.Copy(io.Discard, resp.Body)
 	return nil
 }
 
+// RemoteWrite 推送错误
+type RemoteWriteError struct {
+	Url         string
+	StatusCode  int           // http状态码, 网络错误时为0
+	Recoverable bool          // 是否可以重试, 网络错误, 5xx 和 429 可以重试, 其它 4xx 不可重试
+	RetryAfter  time.Duration // 服务端通过 Retry-After 要求的重试等待时间
+	Err         error
+}
+
+func (e *RemoteWriteError) Error() string { return e.Err.Error() }
+func (e *RemoteWriteError) Unwrap() error { return e.Err }
+
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if sec, err := strconv.Atoi(v); err == nil {
+		return time.Duration(sec) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// 一次请求的数据
+type writeBatch struct {
+	body    []byte // snappy 压缩后的请求体
+	samples int    // 样本数
+	series  int    // 时间序列数
+	size    int    // 压缩前的大小
+}
+
+// 收集数据, 按时间序列的标签哈希分配到各个分片, 并按每次请求的最大样本数切分为多个请求
+func (p *RemoteWrite) collectBatches(shards, maxSamplesPerSend int) ([][]writeBatch, error) {
+	if p.error != nil {
+		return nil, p.error
+	}
+	if shards < 1 {
+		shards = 1
+	}
+	ret := make([][]writeBatch, shards)
+
+	if p.protocolVersion == RemoteWriteProtocolV2 {
+		wr, err := p.toWriteV2Request()
+		if err != nil {
+			return nil, err
+		}
+		sharded := make([][]int, shards)
+		for i := range wr.Timeseries {
+			shard := labelsRefsHash(wr.Symbols, wr.Timeseries[i].LabelsRefs) % uint64(shards)
+			sharded[shard] = append(sharded[shard], i)
+		}
+		for shard, indexes := range sharded {
+			splitBySamples(len(indexes), maxSamplesPerSend, func(i int) int {
+				s := &wr.Timeseries[indexes[i]]
+				return len(s.Samples) + len(s.Histograms)
+			}, func(start, end, samples int) {
+				body := wr.subRequest(indexes[start:end]).Marshal()
+				ret[shard] = append(ret[shard], writeBatch{body: snappy.Encode(nil, body), samples: samples, series: end - start, size: len(body)})
+			})
+		}
+		return ret, nil
+	}
+
+	wr, err := p.toPromWriteRequest()
+	if err != nil {
+		return nil, err
+	}
+	sharded := make([][]prompb.TimeSeries, shards)
+	for _, ts := range wr.Timeseries {
+		shard := labelsHash(ts.Labels) % uint64(shards)
+		sharded[shard] = append(sharded[shard], ts)
+	}
+	for shard, ts := range sharded {
+		var splitErr error
+		splitBySamples(len(ts), maxSamplesPerSend, func(i int) int {
+			return len(ts[i].Samples)
+		}, func(start, end, samples int) {
+			data, err := proto.Marshal(&prompb.WriteRequest{Timeseries: ts[start:end]})
+			if err != nil {
+				splitErr = fmt.Errorf("unable to marshal protobuf: %v", err)
+				return
+			}
+			ret[shard] = append(ret[shard], writeBatch{body: snappy.Encode(nil, data), samples: samples, series: end - start, size: len(data)})
+		})
+		if splitErr != nil {
+			return nil, splitErr
+		}
+	}
+	return ret, nil
+}
+
+// 按样本数切分, 每段样本数不超过 maxSamples, 单个时间序列样本数超过 maxSamples 时独占一段
+func splitBySamples(n, maxSamples int, samplesOf func(i int) int, fn func(start, end, samples int)) {
+	start, samples := 0, 0
+	for i := 0; i < n; i++ {
+		c := samplesOf(i)
+		if i > start && maxSamples > 0 && samples+c > maxSamples {
+			fn(start, i, samples)
+			start, samples = i, 0
+		}
+		samples += c
+	}
+	if n > start {
+		fn(start, n, samples)
+	}
+}
+
+// 标签已按名称排序
+func labelsHash(labels []prompb.Label) uint64 {
+	h := fnv.New64a()
+	for _, l := range labels {
+		_, _ = h.Write([]byte(l.Name))
+		_, _ = h.Write([]byte{0xff})
+		_, _ = h.Write([]byte(l.Value))
+		_, _ = h.Write([]byte{0xff})
+	}
+	return h.Sum64()
+}
+
+func labelsRefsHash(symbols []string, refs []uint32) uint64 {
+	h := fnv.New64a()
+	for _, ref := range refs {
+		_, _ = h.Write([]byte(symbols[ref]))
+		_, _ = h.Write([]byte{0xff})
+	}
+	return h.Sum64()
+}
+
 func (p *RemoteWrite) toPromWriteRequest() (*prompb.WriteRequest, error) {
 	mfs, err := p.gatherers.Gather()
 	if err != nil {
@@ -171,45 +357,31 @@ func (p *RemoteWrite) toPromWriteRequest() (*prompb.WriteRequest, error) {
 	}
 
 	promTs := make([]prompb.TimeSeries, 0, 16)
-	t := time.Now().UnixNano() / 1e6
+	now := time.Now().UnixMilli()
 	for _, mf := range mfs {
-		for _, m := range mf.Metric {
-			mt := m.GetTimestampMs()
-			if mt > 0 {
+		for _, m := range mf.GetMetric() {
+			t := now
+			if m.GetTimestampMs() > 0 {
 				t = m.GetTimestampMs()
 			}
-			//t := m.GetTimestampMs()
-			samples := make([]prompb.Sample, 0, 1)
-			exemplars := make([]prompb.Exemplar, 0, 1)
-			var res []prompb.TimeSeries
-			if *mf.Type == io_prometheus_client.MetricType_SUMMARY {
-				res = p.parseMetricTypeSummary(mf, m, t)
-			} else if *mf.Type == io_prometheus_client.MetricType_HISTOGRAM {
-				res = p.parseMetricTypeHistogram(mf, m, t)
-			} else {
-				labels := p.getMetricLabels(mf, m)
-				switch *mf.Type {
-				case io_prometheus_client.MetricType_COUNTER:
-					samples = append(samples, prompb.Sample{Value: m.GetCounter().GetValue(), Timestamp: t})
-					e, ok := p.getPrompbExemplar(m.GetCounter().GetExemplar(), t)
-					if ok {
-						exemplars = append(exemplars, e)
-					}
-				case io_prometheus_client.MetricType_GAUGE:
-					samples = append(samples, prompb.Sample{Value: m.GetCounter().GetValue(), Timestamp: t})
-					e, ok := p.getPrompbExemplar(m.GetCounter().GetExemplar(), t)
-					if ok {
-						exemplars = append(exemplars, e)
-					}
-				case io_prometheus_client.MetricType_UNTYPED:
-					samples = append(samples, prompb.Sample{Value: m.GetUntyped().GetValue(), Timestamp: t})
-				}
 
-				res = []prompb.TimeSeries{{Labels: labels, Samples: samples, Exemplars: exemplars}}
+			switch mf.GetType() {
+			case io_prometheus_client.MetricType_COUNTER:
+				ts := p.newPromTimeSeries(p.metricLabels(mf, m, mf.GetName()), m.GetCounter().GetValue(), t)
+				if e, ok := p.getPrompbExemplar(m.GetCounter().GetExemplar(), t); ok {
+					ts.Exemplars = append(ts.Exemplars, e)
+				}
+				promTs = append(promTs, ts)
+			case io_prometheus_client.MetricType_GAUGE:
+				promTs = append(promTs, p.newPromTimeSeries(p.metricLabels(mf, m, mf.GetName()), m.GetGauge().GetValue(), t))
+			case io_prometheus_client.MetricType_UNTYPED:
+				promTs = append(promTs, p.newPromTimeSeries(p.metricLabels(mf, m, mf.GetName()), m.GetUntyped().GetValue(), t))
+			case io_prometheus_client.MetricType_SUMMARY:
+				promTs = append(promTs, p.parseMetricTypeSummary(mf, m, t)...)
+			case io_prometheus_client.MetricType_HISTOGRAM, io_prometheus_client.MetricType_GAUGE_HISTOGRAM:
+				promTs = append(promTs, p.parseMetricTypeHistogram(mf, m, t)...)
 			}
-			promTs = append(promTs, res...)
 		}
-
 	}
 
 	return &prompb.WriteRequest{
@@ -217,6 +389,10 @@ func (p *RemoteWrite) toPromWriteRequest() (*prompb.WriteRequest, error) {
 	}, nil
 }
 
+func (p *RemoteWrite) newPromTimeSeries(labels []prompb.Label, v float64, t int64) prompb.TimeSeries {
+	return prompb.TimeSeries{Labels: labels, Samples: []prompb.Sample{{Value: v, Timestamp: t}}}
+}
+
 func (p *RemoteWrite) getPrompbExemplar(e *io_prometheus_client.Exemplar, t int64) (prompb.Exemplar, bool) {
 	ret := prompb.Exemplar{}
 
@@ -226,9 +402,7 @@ func (p *RemoteWrite) getPrompbExemplar(e *io_prometheus_client.Exemplar, t int6
 	if p.expfmtType != expfmt.TypeOpenMetrics {
 		return ret, false
 	}
-	if e.Value != nil {
-		ret.Value = *e.Value
-	}
+	ret.Value = e.GetValue()
 	ret.Timestamp = t
 	if e.Timestamp != nil {
 		ret.Timestamp = e.Timestamp.AsTime().UnixMilli()
@@ -245,75 +419,77 @@ func (p *RemoteWrite) getPrompbExemplar(e *io_prometheus_client.Exemplar, t int6
 	return ret, true
 }
 
+// 汇总, 生成 name{quantile}, name_sum, name_count
 func (p *RemoteWrite) parseMetricTypeSummary(mf *io_prometheus_client.MetricFamily, m *io_prometheus_client.Metric, t int64) []prompb.TimeSeries {
-	sum := p.getMetricTypeSummarySum(mf, m, t)
-	count := p.getMetricTypeSummaryCount(mf, m, t)
-
-	var promTs = []prompb.TimeSeries{sum, count}
-	for _, q := range m.Summary.Quantile {
-		labels := p.getMetricLabels(mf, m)
-		labels = append(labels, prompb.Label{Name: "quantile", Value: fmt.Sprintf("%g", q.GetQuantile())})
-		samples := []prompb.Sample{{Value: q.GetValue(), Timestamp: t}}
-		promTs = append(promTs, prompb.TimeSeries{Labels: labels, Samples: samples})
+	summary := m.GetSummary()
+	promTs := make([]prompb.TimeSeries, 0, len(summary.GetQuantile())+2)
+	for _, q := range summary.GetQuantile() {
+		labels := p.metricLabels(mf, m, mf.GetName(), prompb.Label{Name: "quantile", Value: formatFloat(q.GetQuantile())})
+		promTs = append(promTs, p.newPromTimeSeries(labels, q.GetValue(), t))
 	}
-	return promTs
+	return append(promTs,
+		p.newPromTimeSeries(p.metricLabels(mf, m, mf.GetName()+"_sum"), summary.GetSampleSum(), t),
+		p.newPromTimeSeries(p.metricLabels(mf, m, mf.GetName()+"_count"), float64(summary.GetSampleCount()), t),
+	)
 }
 
+// 直方图, 生成 name_bucket{le}, name_sum, name_count
+//
+// 原生直方图无法通过 1.0 协议发送, 如果只有原生直方图桶则只发送 name_sum 和 name_count
 func (p *RemoteWrite) parseMetricTypeHistogram(mf *io_prometheus_client.MetricFamily, m *io_prometheus_client.Metric, t int64) []prompb.TimeSeries {
-	sum := p.getMetricTypeHistogramSum(mf, m, t)
-	count := p.getMetricTypeHistogramCount(mf, m, t)
-
-	var promTs = []prompb.TimeSeries{sum, count}
-	for _, b := range m.GetHistogram().GetBucket() {
-		labels := p.getMetricLabels(mf, m)
-		labels = append(labels, prompb.Label{Name: "le", Value: fmt.Sprintf("%g", b.GetUpperBound())})
-		samples := []prompb.Sample{{Value: float64(b.GetCumulativeCount()), Timestamp: t}}
-		promTs = append(promTs, prompb.TimeSeries{Labels: labels, Samples: samples})
+	h := m.GetHistogram()
+	count := float64(h.GetSampleCount())
+	if h.GetSampleCountFloat() > 0 {
+		count = h.GetSampleCountFloat()
 	}
-	labels := p.getMetricLabels(mf, m)
-	labels = append(labels, prompb.Label{Name: "le", Value: fmt.Sprintf("%g", math.Inf(1))})
-	samples := []prompb.Sample{{Value: float64(m.GetHistogram().GetSampleCount()), Timestamp: t}}
-	promTs = append(promTs, prompb.TimeSeries{Labels: labels, Samples: samples})
-	return []prompb.TimeSeries{sum, count}
-}
 
-func (p *RemoteWrite) getMetricTypeHistogramSum(mf *io_prometheus_client.MetricFamily, m *io_prometheus_client.Metric, t int64) prompb.TimeSeries {
-	return prompb.TimeSeries{Labels: p.getMetricLabelsNameWithWithSuffix(mf, m, "sum"),
-		Samples: []prompb.Sample{{Value: m.GetHistogram().GetSampleSum(), Timestamp: t}}}
-}
-
-func (p *RemoteWrite) getMetricTypeHistogramCount(mf *io_prometheus_client.MetricFamily, m *io_prometheus_client.Metric, t int64) prompb.TimeSeries {
-	return prompb.TimeSeries{Labels: p.getMetricLabelsNameWithWithSuffix(mf, m, "count"),
-		Samples: []prompb.Sample{{Value: float64(m.GetHistogram().GetSampleCount()), Timestamp: t}}}
-}
-
-func (p *RemoteWrite) getMetricTypeSummarySum(mf *io_prometheus_client.MetricFamily, m *io_prometheus_client.Metric, t int64) prompb.TimeSeries {
-	return prompb.TimeSeries{Labels: p.getMetricLabelsNameWithWithSuffix(mf, m, "sum"),
-		Samples: []prompb.Sample{{Value: m.GetSummary().GetSampleSum(), Timestamp: t}}}
-}
-
-func (p *RemoteWrite) getMetricTypeSummaryCount(mf *io_prometheus_client.MetricFamily, m *io_prometheus_client.Metric, t int64) prompb.TimeSeries {
-	return prompb.TimeSeries{Labels: p.getMetricLabelsNameWithWithSuffix(mf, m, "count"),
-		Samples: []prompb.Sample{{Value: float64(m.GetSummary().GetSampleCount()), Timestamp: t}}}
-}
-
-func (p *RemoteWrite) getMetricLabels(mf *io_prometheus_client.MetricFamily, m *io_prometheus_client.Metric) []prompb.Label {
-	return p.getMetricLabelsNameWithWithSuffix(mf, m, "")
-}
-
-func (p *RemoteWrite) getMetricLabelsNameWithWithSuffix(mf *io_prometheus_client.MetricFamily, m *io_prometheus_client.Metric, suffix string) []prompb.Label {
-	labels := make([]prompb.Label, 0, 1)
-	if suffix != "" {
-		if strings.HasPrefix(suffix, "_") {
-			suffix = "_" + suffix
+	promTs := make([]prompb.TimeSeries, 0, len(h.GetBucket())+3)
+	if len(h.GetBucket()) > 0 || !isNativeHistogram(h) {
+		hasInf := false
+		for _, b := range h.GetBucket() {
+			v := float64(b.GetCumulativeCount())
+			if b.GetCumulativeCountFloat() > 0 {
+				v = b.GetCumulativeCountFloat()
+			}
+			if math.IsInf(b.GetUpperBound(), 1) {
+				hasInf = true
+			}
+			labels := p.metricLabels(mf, m, mf.GetName()+"_bucket", prompb.Label{Name: "le", Value: formatFloat(b.GetUpperBound())})
+			ts := p.newPromTimeSeries(labels, v, t)
+			if e, ok := p.getPrompbExemplar(b.GetExemplar(), t); ok {
+				ts.Exemplars = append(ts.Exemplars, e)
+			}
+			promTs = append(promTs, ts)
+		}
+		if !hasInf {
+			labels := p.metricLabels(mf, m, mf.GetName()+"_bucket", prompb.Label{Name: "le", Value: formatFloat(math.Inf(1))})
+			promTs = append(promTs, p.newPromTimeSeries(labels, count, t))
 		}
 	}
-	labels = append(labels, prompb.Label{Name: "__name__", Value: mf.GetName() + suffix})
+	return append(promTs,
+		p.newPromTimeSeries(p.metricLabels(mf, m, mf.GetName()+"_sum"), h.GetSampleSum(), t),
+		p.newPromTimeSeries(p.metricLabels(mf, m, mf.GetName()+"_count"), count, t),
+	)
+}
+
+// 生成按名称排序的标签, name 为包含后缀的指标名, 附加标签不会覆盖指标已有的标签
+func (p *RemoteWrite) metricLabels(mf *io_prometheus_client.MetricFamily, m *io_prometheus_client.Metric, name string, extra ...prompb.Label) []prompb.Label {
+	labels := make([]prompb.Label, 0, len(m.GetLabel())+len(p.labels)+len(extra)+1)
+	labels = append(labels, prompb.Label{Name: "__name__", Value: name})
+	exists := make(map[string]struct{}, len(m.GetLabel())+len(extra))
 	for _, l := range m.GetLabel() {
-		labels = append(labels, prompb.Label{Name: *l.Name, Value: *l.Value})
+		labels = append(labels, prompb.Label{Name: l.GetName(), Value: l.GetValue()})
+		exists[l.GetName()] = struct{}{}
+	}
+	for _, l := range extra {
+		labels = append(labels, l)
+		exists[l.Name] = struct{}{}
 	}
 	for k, v := range p.labels {
-		labels = append(labels, prompb.Label{Name: k, Value: v})
+		if _, ok := exists[k]; !ok {
+			labels = append(labels, prompb.Label{Name: k, Value: v})
+		}
 	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
 	return labels
 }
@@ -0,0 +1,238 @@
+package prometheus
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/zly-app/zapp/core"
+)
+
+// RemoteWrite 发送队列
+//
+// 每次收集的时间序列按标签哈希分配到各个分片, 同一时间序列总是由同一个分片按顺序发送, 各个分片之间并发发送.
+// 可重试的错误(网络错误, 5xx, 429)按指数退避重试, 并遵循服务端返回的 Retry-After; 不可重试的错误(其它 4xx)直接丢弃并计数.
+type writeQueue struct {
+	app   core.IApp
+	conf  *RemoteWriteConfig
+	write *RemoteWrite
+	wal   *writeWAL // 预写日志, 未启用时为nil
+
+	metrics         *selfMetrics
+	pending         atomic.Int64 // 未启用预写日志时等待发送的请求数
+	droppedRequests atomic.Int64 // 丢弃的请求数
+	droppedSamples  atomic.Int64 // 丢弃的样本数
+}
+
+// wal 不为 nil 时复用已打开的预写日志, 否则按配置打开
+func newWriteQueue(app core.IApp, conf *RemoteWriteConfig, write *RemoteWrite, metrics *selfMetrics, wal *writeWAL) (*writeQueue, error) {
+	q := &writeQueue{
+		app:     app,
+		conf:    conf,
+		write:   write,
+		wal:     wal,
+		metrics: metrics,
+	}
+	if wal != nil {
+		wal.setMaxSize(conf.WALMaxSize)
+	} else if conf.WALDir != "" {
+		wal, err := openWriteWAL(conf.WALDir, conf.WALMaxSize)
+		if err != nil {
+			return nil, err
+		}
+		q.wal = wal
+	}
+	return q, nil
+}
+
+// 收集并发送一次数据, 返回未能发送成功的错误
+func (q *writeQueue) Write(ctx context.Context) error {
+	shards, err := q.write.collectBatches(q.conf.Shards, q.conf.MaxSamplesPerSend)
+	if err != nil {
+		q.app.Error("metrics RemoteWrite Collect 失败", zap.String("target", q.conf.Name), zap.Error(err))
+		return err
+	}
+	start := time.Now()
+	var requests, samples, series, size, compressedSize int
+	for _, batches := range shards {
+		for _, b := range batches {
+			requests++
+			samples += b.samples
+			series += b.series
+			size += b.size
+			compressedSize += len(b.body)
+		}
+	}
+	q.metrics.observeWrite(exporterRemoteWrite, q.conf.Name, samples, series, size)
+	if q.wal == nil {
+		q.pending.Add(int64(requests))
+	}
+
+	// 先按顺序重放打开预写日志时已存在的记录, 失败时新的数据只写入预写日志
+	var replayErr error
+	if q.wal != nil {
+		replayErr = q.sendWAL(ctx, walReplayShard)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(shards)+1)
+	errs[len(shards)] = replayErr
+	for shard, batches := range shards {
+		if len(batches) == 0 && q.wal == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(shard int, batches []writeBatch) {
+			defer wg.Done()
+			if q.wal != nil {
+				errs[shard] = q.writeShardWithWAL(ctx, shard, batches, replayErr == nil)
+				return
+			}
+			for _, b := range batches {
+				if err := q.send(ctx, q.conf.ProtocolVersion, b.body); err != nil {
+					q.drop(shard, 1, b.samples, err)
+					errs[shard] = err
+				}
+				q.pending.Add(-1)
+			}
+		}(shard, batches)
+	}
+	wg.Wait()
+	err = errors.Join(errs...)
+	q.app.Debug("metrics RemoteWrite 完成",
+		zap.String("target", q.conf.Name),
+		zap.Duration("duration", time.Since(start)),
+		zap.Int("requests", requests),
+		zap.Int("samples", samples),
+		zap.Int("series", series),
+		zap.Int("bytes", size),
+		zap.Int("compressedBytes", compressedSize),
+		zap.Int("queueDepth", q.Depth()),
+		zap.Error(err),
+	)
+	return err
+}
+
+// 先写入预写日志, send 为 true 时再按顺序发送分片在预写日志中的所有数据
+func (q *writeQueue) writeShardWithWAL(ctx context.Context, shard int, batches []writeBatch, send bool) error {
+	var lastErr error
+	for _, b := range batches {
+		dropped, err := q.wal.Append(shard, q.conf.ProtocolVersion, b)
+		if err != nil {
+			q.app.Error("metrics RemoteWrite 写入预写日志失败, 直接发送", zap.String("target", q.conf.Name), zap.Int("shard", shard), zap.Error(err))
+			if err = q.send(ctx, q.conf.ProtocolVersion, b.body); err != nil {
+				q.drop(shard, 1, b.samples, err)
+				lastErr = err
+			}
+			continue
+		}
+		for _, r := range dropped {
+			q.drop(r.shard, 1, r.samples, errors.New("wal size limit exceeded"))
+		}
+	}
+
+	if !send {
+		return lastErr
+	}
+	if err := q.sendWAL(ctx, shard); err != nil {
+		return err
+	}
+	return lastErr
+}
+
+// 按顺序发送分片在预写日志中的所有数据
+func (q *writeQueue) sendWAL(ctx context.Context, shard int) error {
+	var lastErr error
+	for {
+		record, version, body, ok, err := q.wal.Peek(shard)
+		if err != nil {
+			q.app.Error("metrics RemoteWrite 读取预写日志失败", zap.String("target", q.conf.Name), zap.Int("shard", shard), zap.Error(err))
+			return err
+		}
+		if !ok {
+			return lastErr
+		}
+
+		err = q.send(ctx, version, body)
+		if err != nil {
+			if isRecoverableWriteError(err) || ctx.Err() != nil { // 保留数据等待下次重放
+				q.wal.Release(record.seq)
+				q.app.Warn("metrics RemoteWrite 数据已保留在预写日志中等待重放", zap.String("target", q.conf.Name), zap.Int("shard", shard), zap.Int("pending", q.wal.Len()))
+				return err
+			}
+			q.drop(shard, 1, record.samples, err)
+			lastErr = err
+		}
+		q.wal.Remove(record.seq)
+	}
+}
+
+// 发送请求, 可重试的错误按指数退避重试
+func (q *writeQueue) send(ctx context.Context, protocolVersion string, body []byte) error {
+	backoff := time.Duration(q.conf.RetryInterval) * time.Millisecond
+	maxBackoff := time.Duration(q.conf.RetryMaxInterval) * time.Millisecond
+	for attempt := uint32(0); ; attempt++ {
+		start := time.Now()
+		err := q.write.PushPayload(ctx, protocolVersion, body)
+		q.metrics.observeRequest(exporterRemoteWrite, q.conf.Name, start, len(body), err)
+		if err == nil {
+			return nil
+		}
+		if !isRecoverableWriteError(err) || attempt >= q.conf.Retry || ctx.Err() != nil {
+			return err
+		}
+
+		wait := backoff
+		var writeErr *RemoteWriteError
+		if errors.As(err, &writeErr) && writeErr.RetryAfter > 0 {
+			wait = writeErr.RetryAfter
+		}
+		q.app.Warn("metrics RemoteWrite 失败, 等待重试", zap.String("target", q.conf.Name), zap.Uint32("attempt", attempt+1), zap.Duration("wait", wait), zap.Error(err))
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// 等待发送的请求数, 启用预写日志时为预写日志中的记录数
+func (q *writeQueue) Depth() int {
+	if q.wal != nil {
+		return q.wal.Len()
+	}
+	return int(q.pending.Load())
+}
+
+// 丢弃数据并计数
+func (q *writeQueue) drop(shard int, requests, samples int, err error) {
+	q.droppedRequests.Add(int64(requests))
+	q.droppedSamples.Add(int64(samples))
+	q.app.Error("metrics RemoteWrite 失败, 丢弃数据",
+		zap.String("target", q.conf.Name),
+		zap.Int("shard", shard),
+		zap.Int("samples", samples),
+		zap.Int64("droppedRequests", q.droppedRequests.Load()),
+		zap.Int64("droppedSamples", q.droppedSamples.Load()),
+		zap.Error(err),
+	)
+}
+
+func isRecoverableWriteError(err error) bool {
+	var writeErr *RemoteWriteError
+	if errors.As(err, &writeErr) {
+		return writeErr.Recoverable
+	}
+	return false
+}
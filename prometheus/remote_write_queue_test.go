@@ -0,0 +1,253 @@
+package prometheus
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/zly-app/zapp/core"
+)
+
+// 接收端收到的请求
+type receivedRequest struct {
+	header http.Header
+	body   []byte    // snappy 解压后的请求体
+	at     time.Time // 收到请求的时间
+	err    error     // 读取或解压请求体失败的错误
+}
+
+// 接收端的响应, 为空的字段使用默认值
+type testResponse struct {
+	code       int    // 状态码, 默认为 204
+	retryAfter string // Retry-After 响应头
+}
+
+// 进程内的 RemoteWrite 接收端
+//
+// 收到的请求通过 requests 交给测试协程检查, 不在 handler 中调用 t.Fatal.
+// 依次返回 responses 中的响应, 用完后返回 204.
+type testReceiver struct {
+	*httptest.Server
+	requests chan receivedRequest
+
+	mx        sync.Mutex
+	responses []testResponse
+}
+
+func startTestReceiver(responses ...testResponse) *testReceiver {
+	r := &testReceiver{requests: make(chan receivedRequest, 1024), responses: responses}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.handle))
+	return r
+}
+
+func (r *testReceiver) handle(w http.ResponseWriter, req *http.Request) {
+	got := receivedRequest{header: req.Header.Clone(), at: time.Now()}
+	compressed, err := io.ReadAll(req.Body)
+	if err == nil {
+		got.body, err = snappy.Decode(nil, compressed)
+	}
+	got.err = err
+
+	resp := testResponse{code: http.StatusNoContent}
+	r.mx.Lock()
+	if len(r.responses) > 0 {
+		resp = r.responses[0]
+		r.responses = r.responses[1:]
+	}
+	r.mx.Unlock()
+
+	r.requests <- got
+	if resp.retryAfter != "" {
+		w.Header().Set("Retry-After", resp.retryAfter)
+	}
+	w.WriteHeader(resp.code)
+}
+
+// 取出已收到的所有请求, 请求体读取失败时终止测试
+func (r *testReceiver) received(t *testing.T) []receivedRequest {
+	t.Helper()
+	var ret []receivedRequest
+	for {
+		select {
+		case got := <-r.requests:
+			if got.err != nil {
+				t.Fatalf("read request body err: %v", got.err)
+			}
+			ret = append(ret, got)
+		default:
+			return ret
+		}
+	}
+}
+
+// 只实现日志方法的 app
+type testApp struct{ core.IApp }
+
+func (testApp) Debug(v ...interface{}) {}
+func (testApp) Info(v ...interface{})  {}
+func (testApp) Warn(v ...interface{})  {}
+func (testApp) Error(v ...interface{}) {}
+
+// 创建发送到 url 的队列, 注册一个计量器
+func newTestWriteQueue(t *testing.T, url string, setConf func(conf *RemoteWriteConfig)) *writeQueue {
+	t.Helper()
+	conf := &RemoteWriteConfig{Name: "test", Address: url}
+	if setConf != nil {
+		setConf(conf)
+	}
+	conf.check()
+
+	rw := NewRemoteWrite(url)
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_gauge", Help: "gauge"})
+	gauge.Set(1)
+	rw.Collector(gauge)
+	q, err := newWriteQueue(testApp{}, conf, rw, nil, nil)
+	if err != nil {
+		t.Fatalf("new write queue err: %v", err)
+	}
+	return q
+}
+
+func TestWriteQueueRetryAfter(t *testing.T) {
+	srv := startTestReceiver(testResponse{code: http.StatusTooManyRequests, retryAfter: "1"})
+	defer srv.Close()
+
+	q := newTestWriteQueue(t, srv.URL, func(conf *RemoteWriteConfig) {
+		conf.Retry = 2
+		conf.RetryInterval = 10
+	})
+	if err := q.Write(context.Background()); err != nil {
+		t.Fatalf("write err: %v", err)
+	}
+	got := srv.received(t)
+	if len(got) != 2 {
+		t.Fatalf("received %d requests, want 2", len(got))
+	}
+	if wait := got[1].at.Sub(got[0].at); wait < time.Second {
+		t.Errorf("retried after %v, want Retry-After 1s", wait)
+	}
+}
+
+func TestWriteQueueBackoff(t *testing.T) {
+	srv := startTestReceiver(testResponse{code: http.StatusInternalServerError}, testResponse{code: http.StatusInternalServerError})
+	defer srv.Close()
+
+	q := newTestWriteQueue(t, srv.URL, func(conf *RemoteWriteConfig) {
+		conf.Retry = 2
+		conf.RetryInterval = 50
+	})
+	if err := q.Write(context.Background()); err != nil {
+		t.Fatalf("write err: %v", err)
+	}
+	got := srv.received(t)
+	if len(got) != 3 {
+		t.Fatalf("received %d requests, want 3", len(got))
+	}
+	for i, want := range []time.Duration{50 * time.Millisecond, 100 * time.Millisecond} { // 每次重试后翻倍
+		if wait := got[i+1].at.Sub(got[i].at); wait < want {
+			t.Errorf("retry %d after %v, want at least %v", i+1, wait, want)
+		}
+	}
+}
+
+func TestWriteQueueDropClientError(t *testing.T) {
+	srv := startTestReceiver(testResponse{code: http.StatusBadRequest})
+	defer srv.Close()
+
+	q := newTestWriteQueue(t, srv.URL, func(conf *RemoteWriteConfig) { conf.Retry = 2 })
+	if err := q.Write(context.Background()); err == nil {
+		t.Fatalf("write err = nil, want 400")
+	}
+	if got := srv.received(t); len(got) != 1 {
+		t.Errorf("received %d requests, want 1 without retry", len(got))
+	}
+	if n := q.droppedRequests.Load(); n != 1 {
+		t.Errorf("dropped requests = %d, want 1", n)
+	}
+	if n := q.droppedSamples.Load(); n != 1 {
+		t.Errorf("dropped samples = %d, want 1", n)
+	}
+}
+
+func TestWriteQueueShardsAndMaxSamples(t *testing.T) {
+	srv := startTestReceiver()
+	defer srv.Close()
+
+	const shards, maxSamples = 3, 2
+	q := newTestWriteQueue(t, srv.URL, func(conf *RemoteWriteConfig) {
+		conf.Shards = shards
+		conf.MaxSamplesPerSend = maxSamples
+	})
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_sharded", Help: "gauge"}, []string{"k"})
+	for i := 0; i < 10; i++ {
+		gauge.WithLabelValues(strconv.Itoa(i)).Set(float64(i))
+	}
+	q.write.Collector(gauge)
+
+	// 同一时间序列总是分配到同一个分片
+	shardOf := func() map[string]int {
+		batches, err := q.write.collectBatches(shards, maxSamples)
+		if err != nil {
+			t.Fatalf("collect err: %v", err)
+		}
+		ret := map[string]int{}
+		for shard, list := range batches {
+			for _, b := range list {
+				body, err := snappy.Decode(nil, b.body)
+				if err != nil {
+					t.Fatalf("snappy decode err: %v", err)
+				}
+				for k := range decodeWriteV1(t, body) {
+					ret[k] = shard
+				}
+			}
+		}
+		return ret
+	}
+	first := shardOf()
+	if len(first) != 11 {
+		t.Fatalf("collected %d series, want 11", len(first))
+	}
+	for k, shard := range shardOf() {
+		if first[k] != shard {
+			t.Errorf("series %s moved from shard %d to %d", k, first[k], shard)
+		}
+	}
+	perShard := make([]int, shards)
+	for _, shard := range first {
+		perShard[shard]++
+	}
+
+	if err := q.Write(context.Background()); err != nil {
+		t.Fatalf("write err: %v", err)
+	}
+	wantRequests := 0
+	for _, n := range perShard {
+		wantRequests += (n + maxSamples - 1) / maxSamples
+	}
+	got := srv.received(t)
+	if len(got) != wantRequests {
+		t.Errorf("received %d requests, want %d", len(got), wantRequests)
+	}
+	seen := receivedSeries{}
+	for _, req := range got {
+		series := decodeWriteV1(t, req.body)
+		if len(series) > maxSamples {
+			t.Errorf("request has %d samples, want at most %d", len(series), maxSamples)
+		}
+		for k, v := range series {
+			seen[k] = v
+		}
+	}
+	if len(seen) != 11 {
+		t.Errorf("received %d series, want 11", len(seen))
+	}
+}
@@ -0,0 +1,188 @@
+package prometheus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	io_prometheus_client "github.com/prometheus/client_model/go"
+
+	"github.com/zly-app/zapp/pkg/utils"
+)
+
+const defaultRemoteWriteName = "default"
+
+// RemoteWrite 目标配置, 各字段的含义与 Config 中 Write 开头的字段一致
+type RemoteWriteConfig struct {
+	Name              string           // 目标名称, 用于日志和自身指标的 target 标签, 不能重复. 如果为空则设为地址的 host
+	Address           string           // RemoteWrite 地址, 如: 'http://127.0.0.1:9090/api/v1/write'
+	Instance          string           // 实例, 一般为ip或主机名
+	TimeInterval      int64            // 推送时间间隔, 单位毫秒
+	Retry             uint32           // 推送重试次数, 只有网络错误, 5xx 和 429 会重试, 其它 4xx 直接丢弃
+	RetryInterval     int64            // 推送重试时间间隔, 单位毫秒, 每次重试后翻倍. 服务端返回 Retry-After 时以其为准
+	RetryMaxInterval  int64            // 推送最大重试时间间隔, 单位毫秒
+	Shards            int              // 分片数, 时间序列按标签哈希分配到各个分片并发发送
+	MaxSamplesPerSend int              // 每次请求的最大样本数, 超出后拆分为多个请求
+	HTTP              HTTPClientConfig // http 客户端配置, 包括认证, 额外请求头和 TLS
+	RelabelConfigs    []RelabelConfig  // 发送前的重新标记规则, 与 Prometheus 的 write_relabel_configs 一致
+	ProtocolVersion   string           // 协议版本, 可选 1.0, 2.0
+	WALDir            string           // 预写日志目录, 如果为空则不启用. 多个目标不能使用相同的目录
+	WALMaxSize        int64            // 预写日志最大占用磁盘大小, 单位字节, 超出后丢弃最旧的数据
+}
+
+func (c *RemoteWriteConfig) check() {
+	if c.Name == "" {
+		if u, err := url.Parse(c.Address); err == nil && u.Host != "" {
+			c.Name = u.Host
+		} else {
+			c.Name = c.Address
+		}
+	}
+	if c.Instance == "" {
+		c.Instance = utils.GetInstance("")
+	}
+	if c.TimeInterval < 1 {
+		c.TimeInterval = defaultWriteTimeInterval
+	}
+	if c.RetryInterval < 1 {
+		c.RetryInterval = defaultWriteRetryInterval
+	}
+	if c.RetryMaxInterval < 1 {
+		c.RetryMaxInterval = defaultWriteRetryMaxInterval
+	}
+	if c.RetryMaxInterval < c.RetryInterval {
+		c.RetryMaxInterval = c.RetryInterval
+	}
+	if c.Shards < 1 {
+		c.Shards = defaultWriteShards
+	}
+	if c.MaxSamplesPerSend < 1 {
+		c.MaxSamplesPerSend = defaultWriteMaxSamplesPerSend
+	}
+	if c.ProtocolVersion != RemoteWriteProtocolV2 {
+		c.ProtocolVersion = defaultWriteProtocolVersion
+	}
+	if c.WALMaxSize < 1 {
+		c.WALMaxSize = defaultWriteWALMaxSize
+	}
+}
+
+// 所有 RemoteWrite 目标, 配置了 WriteAddress 时其作为第一个目标
+func (conf *Config) remoteWriteTargets() ([]*RemoteWriteConfig, error) {
+	targets := make([]*RemoteWriteConfig, 0, len(conf.RemoteWrites)+1)
+	if conf.WriteAddress != "" {
+		targets = append(targets, &RemoteWriteConfig{
+			Name:              defaultRemoteWriteName,
+			Address:           conf.WriteAddress,
+			Instance:          conf.WriteInstance,
+			TimeInterval:      conf.WriteTimeInterval,
+			Retry:             conf.WriteRetry,
+			RetryInterval:     conf.WriteRetryInterval,
+			RetryMaxInterval:  conf.WriteRetryMaxInterval,
+			Shards:            conf.WriteShards,
+			MaxSamplesPerSend: conf.WriteMaxSamplesPerSend,
+			HTTP:              conf.WriteHTTP,
+			RelabelConfigs:    conf.WriteRelabelConfigs,
+			ProtocolVersion:   conf.WriteProtocolVersion,
+			WALDir:            conf.WriteWALDir,
+			WALMaxSize:        conf.WriteWALMaxSize,
+		})
+	}
+	for i := range conf.RemoteWrites {
+		targets = append(targets, &conf.RemoteWrites[i])
+	}
+
+	names := make(map[string]struct{}, len(targets))
+	walDirs := make(map[string]struct{}, len(targets))
+	for _, t := range targets {
+		if t.Address == "" {
+			return nil, fmt.Errorf("remote write target %q address is empty", t.Name)
+		}
+		if _, ok := names[t.Name]; ok {
+			return nil, fmt.Errorf("remote write target name %q is duplicated", t.Name)
+		}
+		names[t.Name] = struct{}{}
+		if t.WALDir == "" {
+			continue
+		}
+		if _, ok := walDirs[t.WALDir]; ok {
+			return nil, fmt.Errorf("remote write target %q wal dir %q is duplicated", t.Name, t.WALDir)
+		}
+		walDirs[t.WALDir] = struct{}{}
+	}
+	return targets, nil
+}
+
+// RemoteWrite 目标
+type writeTarget struct {
+	conf     *RemoteWriteConfig
+	write    *RemoteWrite
+	queue    *writeQueue
+	snapshot *snapshotGatherer // 本次收集的数据, 经过目标的重新标记规则后发送
+}
+
+// 按推送间隔分组, 相同间隔的目标共用同一次收集
+func groupWriteTargets(targets []*writeTarget) [][]*writeTarget {
+	groups := make(map[int64][]*writeTarget)
+	intervals := make([]int64, 0)
+	for _, t := range targets {
+		if _, ok := groups[t.conf.TimeInterval]; !ok {
+			intervals = append(intervals, t.conf.TimeInterval)
+		}
+		groups[t.conf.TimeInterval] = append(groups[t.conf.TimeInterval], t)
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i] < intervals[j] })
+
+	ret := make([][]*writeTarget, 0, len(intervals))
+	for _, interval := range intervals {
+		ret = append(ret, groups[interval])
+	}
+	return ret
+}
+
+// 收集一次数据并并发写入所有目标, 返回各个目标未能发送成功的错误
+func writeTargetsOnce(ctx context.Context, gatherer prometheus.Gatherer, targets []*writeTarget) error {
+	mfs, err := gatherer.Gather()
+	for _, t := range targets {
+		t.snapshot.set(mfs, err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(targets))
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t *writeTarget) {
+			defer wg.Done()
+			if err := t.queue.Write(ctx); err != nil {
+				errs[i] = fmt.Errorf("target %s: %v", t.conf.Name, err)
+			}
+		}(i, t)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// 返回最近一次收集结果的收集器
+//
+// 多个目标共用同一次收集的数据, 每个目标的重新标记规则会复制指标后再修改, 不会影响其它目标.
+type snapshotGatherer struct {
+	mx  sync.RWMutex
+	mfs []*io_prometheus_client.MetricFamily
+	err error
+}
+
+func (g *snapshotGatherer) set(mfs []*io_prometheus_client.MetricFamily, err error) {
+	g.mx.Lock()
+	g.mfs, g.err = mfs, err
+	g.mx.Unlock()
+}
+
+func (g *snapshotGatherer) Gather() ([]*io_prometheus_client.MetricFamily, error) {
+	g.mx.RLock()
+	defer g.mx.RUnlock()
+	return g.mfs, g.err
+}
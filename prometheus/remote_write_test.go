@@ -0,0 +1,427 @@
+package prometheus
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	io_prometheus_client "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/prompb"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// 接收到的时间序列, key 为 name{label="value",...}
+type receivedSeries map[string]float64
+
+func seriesKey(labels []prompb.Label) string {
+	name := ""
+	pairs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		if l.Name == "__name__" {
+			name = l.Value
+			continue
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=%q", l.Name, l.Value))
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func labelsSorted(labels []prompb.Label) bool {
+	return sort.SliceIsSorted(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+}
+
+// 注册所有类型的指标, 返回期望收到的时间序列
+func registerTestMetrics(rw *RemoteWrite) receivedSeries {
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_counter_total", Help: "counter"}, []string{"k"})
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_gauge", Help: "gauge"}, []string{"k"})
+	untyped := prometheus.NewUntypedFunc(prometheus.UntypedOpts{Name: "test_untyped", Help: "untyped"}, func() float64 { return 7 })
+	summary := prometheus.NewSummaryVec(prometheus.SummaryOpts{
+		Name:       "test_summary",
+		Help:       "summary",
+		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01},
+	}, []string{"k"})
+	histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "test_histogram",
+		Help:    "histogram",
+		Buckets: []float64{1, 5},
+	}, []string{"k"})
+	rw.Collector(counter).Collector(gauge).Collector(untyped).Collector(summary).Collector(histogram)
+	rw.Gatherer(gaugeHistogramGatherer(false))
+
+	counter.WithLabelValues("a").Add(3)
+	gauge.WithLabelValues("a").Set(2.5)
+	for i := 0; i < 10; i++ {
+		summary.WithLabelValues("a").Observe(4)
+	}
+	for _, v := range []float64{0.5, 3, 10} {
+		histogram.WithLabelValues("a").Observe(v)
+	}
+
+	return receivedSeries{
+		`test_counter_total{app="test",k="a"}`:              3,
+		`test_gauge{app="test",k="a"}`:                      2.5,
+		`test_untyped{app="test"}`:                          7,
+		`test_summary{app="test",k="a",quantile="0.5"}`:     4,
+		`test_summary{app="test",k="a",quantile="0.9"}`:     4,
+		`test_summary_sum{app="test",k="a"}`:                40,
+		`test_summary_count{app="test",k="a"}`:              10,
+		`test_histogram_bucket{app="test",k="a",le="1"}`:    1,
+		`test_histogram_bucket{app="test",k="a",le="5"}`:    2,
+		`test_histogram_bucket{app="test",k="a",le="+Inf"}`: 3,
+		`test_histogram_sum{app="test",k="a"}`:              13.5,
+		`test_histogram_count{app="test",k="a"}`:            3,
+
+		`test_gauge_histogram_bucket{app="test",k="a",le="1"}`:    1,
+		`test_gauge_histogram_bucket{app="test",k="a",le="5"}`:    2,
+		`test_gauge_histogram_bucket{app="test",k="a",le="+Inf"}`: 3,
+		`test_gauge_histogram_sum{app="test",k="a"}`:              3.5,
+		`test_gauge_histogram_count{app="test",k="a"}`:            3,
+	}
+}
+
+// 提供仪表直方图, client_golang 不会生成这种类型. native 为 true 时只有原生直方图桶
+func gaugeHistogramGatherer(native bool) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*io_prometheus_client.MetricFamily, error) {
+		h := &io_prometheus_client.Histogram{
+			SampleCount: proto.Uint64(3),
+			SampleSum:   proto.Float64(3.5),
+		}
+		if native {
+			h.Schema = proto.Int32(0)
+			h.PositiveSpan = []*io_prometheus_client.BucketSpan{{Offset: proto.Int32(0), Length: proto.Uint32(2)}}
+			h.PositiveDelta = []int64{1, 1}
+		} else {
+			h.Bucket = []*io_prometheus_client.Bucket{
+				{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(1)},
+				{UpperBound: proto.Float64(5), CumulativeCount: proto.Uint64(2)},
+			}
+		}
+		return []*io_prometheus_client.MetricFamily{{
+			Name: proto.String("test_gauge_histogram"),
+			Help: proto.String("gauge histogram"),
+			Type: io_prometheus_client.MetricType_GAUGE_HISTOGRAM.Enum(),
+			Metric: []*io_prometheus_client.Metric{{
+				Label:     []*io_prometheus_client.LabelPair{{Name: proto.String("k"), Value: proto.String("a")}},
+				Histogram: h,
+			}},
+		}}, nil
+	})
+}
+
+func checkReceivedSeries(t *testing.T, expect, got receivedSeries) {
+	t.Helper()
+	for k, v := range expect {
+		gv, ok := got[k]
+		if !ok {
+			t.Errorf("missing series %s", k)
+			continue
+		}
+		if math.Abs(gv-v) > 1e-9 {
+			t.Errorf("series %s value = %v, want %v", k, gv, v)
+		}
+	}
+	for k := range got {
+		if _, ok := expect[k]; !ok {
+			t.Errorf("unexpected series %s", k)
+		}
+	}
+}
+
+func TestRemoteWriteV1(t *testing.T) {
+	srv := startTestReceiver()
+	defer srv.Close()
+
+	rw := NewRemoteWrite(srv.URL)
+	rw.ExtraLabel("app", "test")
+	expect := registerTestMetrics(rw)
+	if err := rw.Push(); err != nil {
+		t.Fatalf("push err: %v", err)
+	}
+
+	got := receivedSeries{}
+	for _, req := range srv.received(t) {
+		if v := req.header.Get("X-Prometheus-Remote-Write-Version"); v != "0.1.0" {
+			t.Errorf("remote write version header = %q", v)
+		}
+		for k, v := range decodeWriteV1(t, req.body) {
+			got[k] = v
+		}
+	}
+	checkReceivedSeries(t, expect, got)
+}
+
+func TestRemoteWriteV2(t *testing.T) {
+	srv := startTestReceiver()
+	defer srv.Close()
+
+	rw := NewRemoteWrite(srv.URL)
+	rw.ExtraLabel("app", "test").ProtocolVersion(RemoteWriteProtocolV2)
+	expect := registerTestMetrics(rw)
+	if err := rw.Push(); err != nil {
+		t.Fatalf("push err: %v", err)
+	}
+
+	got := receivedSeries{}
+	types := map[string]uint64{}
+	for _, req := range srv.received(t) {
+		if v := req.header.Get("X-Prometheus-Remote-Write-Version"); v != "2.0.0" {
+			t.Errorf("remote write version header = %q", v)
+		}
+		if v := req.header.Get("Content-Type"); v != writeV2ContentType {
+			t.Errorf("content type header = %q", v)
+		}
+		symbols, series := decodeWriteV2(t, req.body)
+		if len(symbols) == 0 || symbols[0] != "" {
+			t.Errorf("first symbol must be empty string")
+		}
+		for _, s := range series {
+			labels := make([]prompb.Label, 0, len(s.labelsRefs)/2)
+			for i := 0; i+1 < len(s.labelsRefs); i += 2 {
+				labels = append(labels, prompb.Label{Name: symbols[s.labelsRefs[i]], Value: symbols[s.labelsRefs[i+1]]})
+			}
+			if !labelsSorted(labels) {
+				t.Errorf("labels not sorted: %v", labels)
+			}
+			key := seriesKey(labels)
+			got[key] = s.value
+			types[key] = s.metricType
+		}
+	}
+	checkReceivedSeries(t, expect, got)
+
+	expectTypes := map[string]uint64{
+		`test_counter_total{app="test",k="a"}`:           writeV2MetricTypeCounter,
+		`test_gauge{app="test",k="a"}`:                   writeV2MetricTypeGauge,
+		`test_summary_count{app="test",k="a"}`:           writeV2MetricTypeSummary,
+		`test_histogram_bucket{app="test",k="a",le="1"}`: writeV2MetricTypeHistogram,
+
+		`test_gauge_histogram_bucket{app="test",k="a",le="1"}`: writeV2MetricTypeGaugeHistogram,
+		`test_gauge_histogram_count{app="test",k="a"}`:         writeV2MetricTypeGaugeHistogram,
+	}
+	for k, v := range expectTypes {
+		if types[k] != v {
+			t.Errorf("series %s metadata type = %d, want %d", k, types[k], v)
+		}
+	}
+}
+
+func TestRemoteWriteV2NativeGaugeHistogram(t *testing.T) {
+	srv := startTestReceiver()
+	defer srv.Close()
+
+	rw := NewRemoteWrite(srv.URL)
+	rw.ExtraLabel("app", "test").ProtocolVersion(RemoteWriteProtocolV2).Gatherer(gaugeHistogramGatherer(true))
+	if err := rw.Push(); err != nil {
+		t.Fatalf("push err: %v", err)
+	}
+
+	var got []decodedV2Series
+	for _, req := range srv.received(t) {
+		_, series := decodeWriteV2(t, req.body)
+		got = append(got, series...)
+	}
+	if len(got) != 1 {
+		t.Fatalf("received %d series, want 1", len(got))
+	}
+	s := got[0]
+	if s.histograms != 1 || s.resetHint != writeV2HistogramResetHintGauge {
+		t.Errorf("histograms = %d, reset hint = %d, want 1 histogram with reset hint GAUGE", s.histograms, s.resetHint)
+	}
+	if s.metricType != writeV2MetricTypeGaugeHistogram {
+		t.Errorf("metadata type = %d, want %d", s.metricType, writeV2MetricTypeGaugeHistogram)
+	}
+}
+
+func TestWriteV2MetricType(t *testing.T) {
+	for mt, want := range map[io_prometheus_client.MetricType]int32{
+		io_prometheus_client.MetricType_COUNTER:         writeV2MetricTypeCounter,
+		io_prometheus_client.MetricType_GAUGE:           writeV2MetricTypeGauge,
+		io_prometheus_client.MetricType_HISTOGRAM:       writeV2MetricTypeHistogram,
+		io_prometheus_client.MetricType_GAUGE_HISTOGRAM: writeV2MetricTypeGaugeHistogram,
+		io_prometheus_client.MetricType_SUMMARY:         writeV2MetricTypeSummary,
+		io_prometheus_client.MetricType_UNTYPED:         writeV2MetricTypeUnspecified,
+	} {
+		if got := writeV2MetricType(mt); got != want {
+			t.Errorf("metric type %s = %d, want %d", mt, got, want)
+		}
+	}
+}
+
+func TestRemoteWriteRelabelExternalLabels(t *testing.T) {
+	srv := startTestReceiver()
+	defer srv.Close()
+
+	reg := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_gauge", Help: "gauge"}, []string{"app"})
+	gauge.WithLabelValues("mine").Set(1)
+	reg.MustRegister(gauge)
+
+	// 附加的标签不覆盖指标已有的标签, 并且可以被重新标记规则删除
+	rules, err := newRelabelRules([]RelabelConfig{{Regex: "env", Action: "labeldrop"}})
+	if err != nil {
+		t.Fatalf("relabel rules err: %v", err)
+	}
+	external := map[string]string{"app": "test", "env": "prod", "zone": "sh"}
+	rw := NewRemoteWrite(srv.URL).Gatherer(newRelabelGatherer(reg, rules, external))
+	if err := rw.Push(); err != nil {
+		t.Fatalf("push err: %v", err)
+	}
+
+	got := receivedSeries{}
+	for _, req := range srv.received(t) {
+		for k, v := range decodeWriteV1(t, req.body) {
+			got[k] = v
+		}
+	}
+	checkReceivedSeries(t, receivedSeries{`test_gauge{app="mine",zone="sh"}`: 1}, got)
+}
+
+func TestRemoteWriteStatusCode(t *testing.T) {
+	for _, c := range []struct {
+		code        int
+		recoverable bool
+	}{
+		{http.StatusBadRequest, false},
+		{http.StatusTooManyRequests, true},
+		{http.StatusInternalServerError, true},
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "3")
+			w.WriteHeader(c.code)
+		}))
+		rw := NewRemoteWrite(srv.URL)
+		registerTestMetrics(rw)
+		err := rw.Push()
+		srv.Close()
+
+		var writeErr *RemoteWriteError
+		if !errors.As(err, &writeErr) {
+			t.Fatalf("status %d: err = %v, want RemoteWriteError", c.code, err)
+		}
+		if writeErr.StatusCode != c.code || writeErr.Recoverable != c.recoverable {
+			t.Errorf("status %d: got code %d recoverable %v", c.code, writeErr.StatusCode, writeErr.Recoverable)
+		}
+		if writeErr.RetryAfter.Seconds() != 3 {
+			t.Errorf("status %d: retry after = %v", c.code, writeErr.RetryAfter)
+		}
+	}
+}
+
+// 解析 prometheus.WriteRequest 中每个时间序列的第一个样本
+func decodeWriteV1(t *testing.T, b []byte) receivedSeries {
+	t.Helper()
+	var wr prompb.WriteRequest
+	if err := wr.Unmarshal(b); err != nil {
+		t.Fatalf("unmarshal err: %v", err)
+	}
+	got := receivedSeries{}
+	for _, ts := range wr.Timeseries {
+		if !labelsSorted(ts.Labels) {
+			t.Errorf("labels not sorted: %v", ts.Labels)
+		}
+		if len(ts.Samples) != 1 {
+			t.Errorf("series %s has %d samples", seriesKey(ts.Labels), len(ts.Samples))
+			continue
+		}
+		got[seriesKey(ts.Labels)] = ts.Samples[0].Value
+	}
+	return got
+}
+
+type decodedV2Series struct {
+	labelsRefs []uint64
+	value      float64
+	histograms int
+	resetHint  uint64 // 最后一个原生直方图的重置提示
+	metricType uint64
+}
+
+// 解析 io.prometheus.write.v2.Request 中的符号表和时间序列的第一个样本
+func decodeWriteV2(t *testing.T, b []byte) ([]string, []decodedV2Series) {
+	t.Helper()
+	var symbols []string
+	var series []decodedV2Series
+	eachField(t, b, func(num protowire.Number, v []byte, _ uint64) {
+		switch num {
+		case 4:
+			symbols = append(symbols, string(v))
+		case 5:
+			var s decodedV2Series
+			eachField(t, v, func(num protowire.Number, v []byte, _ uint64) {
+				switch num {
+				case 1:
+					for len(v) > 0 {
+						ref, n := protowire.ConsumeVarint(v)
+						s.labelsRefs = append(s.labelsRefs, ref)
+						v = v[n:]
+					}
+				case 2:
+					eachField(t, v, func(num protowire.Number, _ []byte, x uint64) {
+						if num == 1 {
+							s.value = math.Float64frombits(x)
+						}
+					})
+				case 3:
+					s.histograms++
+					eachField(t, v, func(num protowire.Number, _ []byte, x uint64) {
+						if num == 14 {
+							s.resetHint = x
+						}
+					})
+				case 5:
+					eachField(t, v, func(num protowire.Number, _ []byte, x uint64) {
+						if num == 1 {
+							s.metricType = x
+						}
+					})
+				}
+			})
+			series = append(series, s)
+		}
+	})
+	return symbols, series
+}
+
+// 遍历消息字段, bytes 类型的字段值通过 v 返回, 数值类型的字段值通过 x 返回
+func eachField(t *testing.T, b []byte, fn func(num protowire.Number, v []byte, x uint64)) {
+	t.Helper()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("invalid tag")
+		}
+		b = b[n:]
+		switch typ {
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				t.Fatalf("invalid bytes field %d", num)
+			}
+			fn(num, v, 0)
+			b = b[n:]
+		case protowire.VarintType:
+			x, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				t.Fatalf("invalid varint field %d", num)
+			}
+			fn(num, nil, x)
+			b = b[n:]
+		case protowire.Fixed64Type:
+			x, n := protowire.ConsumeFixed64(b)
+			if n < 0 {
+				t.Fatalf("invalid fixed64 field %d", num)
+			}
+			fn(num, nil, x)
+			b = b[n:]
+		default:
+			t.Fatalf("unexpected wire type %d", typ)
+		}
+	}
+}
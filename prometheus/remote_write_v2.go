@@ -0,0 +1,503 @@
+package prometheus
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	io_prometheus_client "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/prometheus/prompb"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// RemoteWrite 协议版本
+const (
+	RemoteWriteProtocolV1 = "1.0"
+	RemoteWriteProtocolV2 = "2.0"
+)
+
+const writeV2ContentType = "application/x-protobuf;proto=io.prometheus.write.v2.Request"
+
+// io.prometheus.write.v2.Metadata.MetricType
+const (
+	writeV2MetricTypeUnspecified    = 0
+	writeV2MetricTypeCounter        = 1
+	writeV2MetricTypeGauge          = 2
+	writeV2MetricTypeHistogram      = 3
+	writeV2MetricTypeGaugeHistogram = 4
+	writeV2MetricTypeSummary        = 5
+)
+
+// io.prometheus.write.v2.Histogram.ResetHint
+const writeV2HistogramResetHintGauge = 3
+
+// io.prometheus.write.v2.Request
+type writeV2Request struct {
+	Symbols    []string
+	Timeseries []writeV2TimeSeries
+}
+
+// io.prometheus.write.v2.TimeSeries
+type writeV2TimeSeries struct {
+	LabelsRefs       []uint32
+	Samples          []writeV2Sample
+	Histograms       []writeV2Histogram
+	Exemplars        []writeV2Exemplar
+	Metadata         writeV2Metadata
+	CreatedTimestamp int64
+}
+
+// io.prometheus.write.v2.Sample
+type writeV2Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+// io.prometheus.write.v2.Exemplar
+type writeV2Exemplar struct {
+	LabelsRefs []uint32
+	Value      float64
+	Timestamp  int64
+}
+
+// io.prometheus.write.v2.Metadata
+type writeV2Metadata struct {
+	Type    int32
+	HelpRef uint32
+	UnitRef uint32
+}
+
+// io.prometheus.write.v2.Histogram, 仅用于原生直方图
+type writeV2Histogram struct {
+	IsFloat        bool // 为 true 时使用 CountFloat/ZeroCountFloat/PositiveCounts/NegativeCounts
+	CountInt       uint64
+	CountFloat     float64
+	Sum            float64
+	Schema         int32
+	ZeroThreshold  float64
+	ZeroCountInt   uint64
+	ZeroCountFloat float64
+	NegativeSpans  []writeV2BucketSpan
+	NegativeDeltas []int64
+	NegativeCounts []float64
+	PositiveSpans  []writeV2BucketSpan
+	PositiveDeltas []int64
+	PositiveCounts []float64
+	ResetHint      int32 // 仪表直方图为 writeV2HistogramResetHintGauge
+	Timestamp      int64
+}
+
+// io.prometheus.write.v2.BucketSpan
+type writeV2BucketSpan struct {
+	Offset int32
+	Length uint32
+}
+
+// 符号表, 第0个符号固定为空字符串
+type writeV2Symbols struct {
+	symbols []string
+	index   map[string]uint32
+}
+
+func newWriteV2Symbols() *writeV2Symbols {
+	s := &writeV2Symbols{index: make(map[string]uint32)}
+	s.ref("")
+	return s
+}
+
+func (s *writeV2Symbols) ref(v string) uint32 {
+	if i, ok := s.index[v]; ok {
+		return i
+	}
+	i := uint32(len(s.symbols))
+	s.symbols = append(s.symbols, v)
+	s.index[v] = i
+	return i
+}
+
+func (s *writeV2Symbols) refLabels(labels []prompb.Label) []uint32 {
+	refs := make([]uint32, 0, len(labels)*2)
+	for _, l := range labels {
+		refs = append(refs, s.ref(l.Name), s.ref(l.Value))
+	}
+	return refs
+}
+
+func (p *RemoteWrite) toWriteV2Request() (*writeV2Request, error) {
+	mfs, err := p.gatherers.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	symbols := newWriteV2Symbols()
+	ts := make([]writeV2TimeSeries, 0, 16)
+	now := time.Now().UnixMilli()
+	for _, mf := range mfs {
+		meta := writeV2Metadata{
+			Type:    writeV2MetricType(mf.GetType()),
+			HelpRef: symbols.ref(mf.GetHelp()),
+			UnitRef: symbols.ref(mf.GetUnit()),
+		}
+		for _, m := range mf.GetMetric() {
+			t := now
+			if m.GetTimestampMs() > 0 {
+				t = m.GetTimestampMs()
+			}
+			ts = append(ts, p.parseMetricV2(symbols, meta, mf, m, t)...)
+		}
+	}
+	return &writeV2Request{Symbols: symbols.symbols, Timeseries: ts}, nil
+}
+
+func (p *RemoteWrite) parseMetricV2(symbols *writeV2Symbols, meta writeV2Metadata, mf *io_prometheus_client.MetricFamily,
+	m *io_prometheus_client.Metric, t int64) []writeV2TimeSeries {
+	name := mf.GetName()
+	series := func(labels []prompb.Label, v float64, created int64) writeV2TimeSeries {
+		return writeV2TimeSeries{
+			LabelsRefs:       symbols.refLabels(labels),
+			Samples:          []writeV2Sample{{Value: v, Timestamp: t}},
+			Metadata:         meta,
+			CreatedTimestamp: created,
+		}
+	}
+
+	switch mf.GetType() {
+	case io_prometheus_client.MetricType_COUNTER:
+		s := series(p.metricLabels(mf, m, name), m.GetCounter().GetValue(), timestampMs(m.GetCounter().GetCreatedTimestamp()))
+		if e, ok := p.getWriteV2Exemplar(symbols, m.GetCounter().GetExemplar(), t); ok {
+			s.Exemplars = append(s.Exemplars, e)
+		}
+		return []writeV2TimeSeries{s}
+	case io_prometheus_client.MetricType_GAUGE:
+		return []writeV2TimeSeries{series(p.metricLabels(mf, m, name), m.GetGauge().GetValue(), 0)}
+	case io_prometheus_client.MetricType_UNTYPED:
+		return []writeV2TimeSeries{series(p.metricLabels(mf, m, name), m.GetUntyped().GetValue(), 0)}
+	case io_prometheus_client.MetricType_SUMMARY:
+		summary := m.GetSummary()
+		created := timestampMs(summary.GetCreatedTimestamp())
+		ret := make([]writeV2TimeSeries, 0, len(summary.GetQuantile())+2)
+		for _, q := range summary.GetQuantile() {
+			labels := p.metricLabels(mf, m, name, prompb.Label{Name: "quantile", Value: formatFloat(q.GetQuantile())})
+			ret = append(ret, series(labels, q.GetValue(), created))
+		}
+		ret = append(ret,
+			series(p.metricLabels(mf, m, name+"_sum"), summary.GetSampleSum(), created),
+			series(p.metricLabels(mf, m, name+"_count"), float64(summary.GetSampleCount()), created),
+		)
+		return ret
+	case io_prometheus_client.MetricType_HISTOGRAM, io_prometheus_client.MetricType_GAUGE_HISTOGRAM:
+		h := m.GetHistogram()
+		created := timestampMs(h.GetCreatedTimestamp())
+		ret := make([]writeV2TimeSeries, 0, len(h.GetBucket())+4)
+		if isNativeHistogram(h) {
+			hist := toWriteV2Histogram(h, t)
+			if mf.GetType() == io_prometheus_client.MetricType_GAUGE_HISTOGRAM {
+				hist.ResetHint = writeV2HistogramResetHintGauge
+			}
+			s := writeV2TimeSeries{
+				LabelsRefs:       symbols.refLabels(p.metricLabels(mf, m, name)),
+				Histograms:       []writeV2Histogram{hist},
+				Metadata:         meta,
+				CreatedTimestamp: created,
+			}
+			for _, e := range h.GetExemplars() {
+				if ex, ok := p.getWriteV2Exemplar(symbols, e, t); ok {
+					s.Exemplars = append(s.Exemplars, ex)
+				}
+			}
+			ret = append(ret, s)
+			if len(h.GetBucket()) == 0 {
+				return ret
+			}
+		}
+
+		count := float64(h.GetSampleCount())
+		if h.GetSampleCountFloat() > 0 {
+			count = h.GetSampleCountFloat()
+		}
+		hasInf := false
+		for _, b := range h.GetBucket() {
+			v := float64(b.GetCumulativeCount())
+			if b.GetCumulativeCountFloat() > 0 {
+				v = b.GetCumulativeCountFloat()
+			}
+			if math.IsInf(b.GetUpperBound(), 1) {
+				hasInf = true
+			}
+			labels := p.metricLabels(mf, m, name+"_bucket", prompb.Label{Name: "le", Value: formatFloat(b.GetUpperBound())})
+			s := series(labels, v, created)
+			if ex, ok := p.getWriteV2Exemplar(symbols, b.GetExemplar(), t); ok {
+				s.Exemplars = append(s.Exemplars, ex)
+			}
+			ret = append(ret, s)
+		}
+		if !hasInf {
+			labels := p.metricLabels(mf, m, name+"_bucket", prompb.Label{Name: "le", Value: formatFloat(math.Inf(1))})
+			ret = append(ret, series(labels, count, created))
+		}
+		ret = append(ret,
+			series(p.metricLabels(mf, m, name+"_sum"), h.GetSampleSum(), created),
+			series(p.metricLabels(mf, m, name+"_count"), count, created),
+		)
+		return ret
+	}
+	return nil
+}
+
+func (p *RemoteWrite) getWriteV2Exemplar(symbols *writeV2Symbols, e *io_prometheus_client.Exemplar, t int64) (writeV2Exemplar, bool) {
+	if e == nil || p.expfmtType != expfmt.TypeOpenMetrics {
+		return writeV2Exemplar{}, false
+	}
+	ret := writeV2Exemplar{Value: e.GetValue(), Timestamp: t}
+	if e.GetTimestamp() != nil {
+		ret.Timestamp = e.GetTimestamp().AsTime().UnixMilli()
+	}
+	labels := make([]prompb.Label, 0, len(e.GetLabel()))
+	for _, l := range e.GetLabel() {
+		labels = append(labels, prompb.Label{Name: l.GetName(), Value: l.GetValue()})
+	}
+	ret.LabelsRefs = symbols.refLabels(labels)
+	return ret, true
+}
+
+func writeV2MetricType(t io_prometheus_client.MetricType) int32 {
+	switch t {
+	case io_prometheus_client.MetricType_COUNTER:
+		return writeV2MetricTypeCounter
+	case io_prometheus_client.MetricType_GAUGE:
+		return writeV2MetricTypeGauge
+	case io_prometheus_client.MetricType_HISTOGRAM:
+		return writeV2MetricTypeHistogram
+	case io_prometheus_client.MetricType_GAUGE_HISTOGRAM:
+		return writeV2MetricTypeGaugeHistogram
+	case io_prometheus_client.MetricType_SUMMARY:
+		return writeV2MetricTypeSummary
+	}
+	return writeV2MetricTypeUnspecified
+}
+
+// 是否为原生直方图
+func isNativeHistogram(h *io_prometheus_client.Histogram) bool {
+	return h.Schema != nil || h.GetZeroThreshold() > 0 || len(h.GetPositiveSpan()) > 0 || len(h.GetNegativeSpan()) > 0
+}
+
+func toWriteV2Histogram(h *io_prometheus_client.Histogram, t int64) writeV2Histogram {
+	ret := writeV2Histogram{
+		IsFloat:        h.GetSampleCountFloat() > 0,
+		CountInt:       h.GetSampleCount(),
+		CountFloat:     h.GetSampleCountFloat(),
+		Sum:            h.GetSampleSum(),
+		Schema:         h.GetSchema(),
+		ZeroThreshold:  h.GetZeroThreshold(),
+		ZeroCountInt:   h.GetZeroCount(),
+		ZeroCountFloat: h.GetZeroCountFloat(),
+		NegativeSpans:  toWriteV2BucketSpans(h.GetNegativeSpan()),
+		NegativeDeltas: h.GetNegativeDelta(),
+		NegativeCounts: h.GetNegativeCount(),
+		PositiveSpans:  toWriteV2BucketSpans(h.GetPositiveSpan()),
+		PositiveDeltas: h.GetPositiveDelta(),
+		PositiveCounts: h.GetPositiveCount(),
+		Timestamp:      t,
+	}
+	return ret
+}
+
+func toWriteV2BucketSpans(spans []*io_prometheus_client.BucketSpan) []writeV2BucketSpan {
+	ret := make([]writeV2BucketSpan, 0, len(spans))
+	for _, s := range spans {
+		ret = append(ret, writeV2BucketSpan{Offset: s.GetOffset(), Length: s.GetLength()})
+	}
+	return ret
+}
+
+func formatFloat(v float64) string {
+	return fmt.Sprintf("%g", v)
+}
+
+// 生成只包含指定时间序列的请求, 并重建符号表
+func (r *writeV2Request) subRequest(indexes []int) *writeV2Request {
+	symbols := newWriteV2Symbols()
+	remap := func(refs []uint32) []uint32 {
+		ret := make([]uint32, len(refs))
+		for i, ref := range refs {
+			ret[i] = symbols.ref(r.Symbols[ref])
+		}
+		return ret
+	}
+
+	ts := make([]writeV2TimeSeries, 0, len(indexes))
+	for _, i := range indexes {
+		s := r.Timeseries[i]
+		s.LabelsRefs = remap(s.LabelsRefs)
+		s.Metadata.HelpRef = symbols.ref(r.Symbols[s.Metadata.HelpRef])
+		s.Metadata.UnitRef = symbols.ref(r.Symbols[s.Metadata.UnitRef])
+		if len(s.Exemplars) > 0 {
+			exemplars := make([]writeV2Exemplar, len(s.Exemplars))
+			for j, e := range s.Exemplars {
+				e.LabelsRefs = remap(e.LabelsRefs)
+				exemplars[j] = e
+			}
+			s.Exemplars = exemplars
+		}
+		ts = append(ts, s)
+	}
+	return &writeV2Request{Symbols: symbols.symbols, Timeseries: ts}
+}
+
+// ---------- protobuf 编码 ----------
+
+func (r *writeV2Request) Marshal() []byte {
+	var b []byte
+	for _, s := range r.Symbols {
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendString(b, s)
+	}
+	for i := range r.Timeseries {
+		b = appendMessage(b, 5, r.Timeseries[i].marshal())
+	}
+	return b
+}
+
+func (s *writeV2TimeSeries) marshal() []byte {
+	var b []byte
+	b = appendPackedUint32(b, 1, s.LabelsRefs)
+	for _, v := range s.Samples {
+		var sb []byte
+		sb = appendDouble(sb, 1, v.Value)
+		sb = appendInt64(sb, 2, v.Timestamp)
+		b = appendMessage(b, 2, sb)
+	}
+	for i := range s.Histograms {
+		b = appendMessage(b, 3, s.Histograms[i].marshal())
+	}
+	for _, e := range s.Exemplars {
+		var eb []byte
+		eb = appendPackedUint32(eb, 1, e.LabelsRefs)
+		eb = appendDouble(eb, 2, e.Value)
+		eb = appendInt64(eb, 3, e.Timestamp)
+		b = appendMessage(b, 4, eb)
+	}
+	var mb []byte
+	mb = appendInt64(mb, 1, int64(s.Metadata.Type))
+	mb = appendInt64(mb, 3, int64(s.Metadata.HelpRef))
+	mb = appendInt64(mb, 4, int64(s.Metadata.UnitRef))
+	b = appendMessage(b, 5, mb)
+	b = appendInt64(b, 6, s.CreatedTimestamp)
+	return b
+}
+
+func (h *writeV2Histogram) marshal() []byte {
+	var b []byte
+	if h.IsFloat {
+		b = protowire.AppendTag(b, 2, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(h.CountFloat))
+	} else {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, h.CountInt)
+	}
+	b = appendDouble(b, 3, h.Sum)
+	if h.Schema != 0 {
+		b = protowire.AppendTag(b, 4, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeZigZag(int64(h.Schema)))
+	}
+	b = appendDouble(b, 5, h.ZeroThreshold)
+	if h.IsFloat {
+		b = protowire.AppendTag(b, 7, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(h.ZeroCountFloat))
+	} else {
+		b = protowire.AppendTag(b, 6, protowire.VarintType)
+		b = protowire.AppendVarint(b, h.ZeroCountInt)
+	}
+	for _, s := range h.NegativeSpans {
+		b = appendMessage(b, 8, s.marshal())
+	}
+	b = appendPackedSint64(b, 9, h.NegativeDeltas)
+	b = appendPackedDouble(b, 10, h.NegativeCounts)
+	for _, s := range h.PositiveSpans {
+		b = appendMessage(b, 11, s.marshal())
+	}
+	b = appendPackedSint64(b, 12, h.PositiveDeltas)
+	b = appendPackedDouble(b, 13, h.PositiveCounts)
+	if h.ResetHint != 0 {
+		b = protowire.AppendTag(b, 14, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.ResetHint))
+	}
+	b = appendInt64(b, 15, h.Timestamp)
+	return b
+}
+
+func (s writeV2BucketSpan) marshal() []byte {
+	var b []byte
+	if s.Offset != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeZigZag(int64(s.Offset)))
+	}
+	if s.Length != 0 {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(s.Length))
+	}
+	return b
+}
+
+func appendMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+func appendDouble(b []byte, num protowire.Number, v float64) []byte {
+	if v == 0 && !math.Signbit(v) {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(v))
+}
+
+func appendInt64(b []byte, num protowire.Number, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+func appendPackedUint32(b []byte, num protowire.Number, vs []uint32) []byte {
+	if len(vs) == 0 {
+		return b
+	}
+	var pb []byte
+	for _, v := range vs {
+		pb = protowire.AppendVarint(pb, uint64(v))
+	}
+	return appendMessage(b, num, pb)
+}
+
+func appendPackedSint64(b []byte, num protowire.Number, vs []int64) []byte {
+	if len(vs) == 0 {
+		return b
+	}
+	var pb []byte
+	for _, v := range vs {
+		pb = protowire.AppendVarint(pb, protowire.EncodeZigZag(v))
+	}
+	return appendMessage(b, num, pb)
+}
+
+func appendPackedDouble(b []byte, num protowire.Number, vs []float64) []byte {
+	if len(vs) == 0 {
+		return b
+	}
+	pb := make([]byte, 0, len(vs)*8)
+	for _, v := range vs {
+		pb = protowire.AppendFixed64(pb, math.Float64bits(v))
+	}
+	return appendMessage(b, num, pb)
+}
+
+func timestampMs(ts *timestamppb.Timestamp) int64 {
+	if ts == nil {
+		return 0
+	}
+	return ts.AsTime().UnixMilli()
+}
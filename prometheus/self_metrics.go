@@ -0,0 +1,204 @@
+package prometheus
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	exporterPush        = "push"
+	exporterRemoteWrite = "remote_write"
+	exporterInflux      = "influx"
+)
+
+// 发送器自身的指标, 注册到 registry 中, 用于监控 push, RemoteWrite 和 InfluxDB 是否正常发送
+//
+// 所有方法都可以在 nil 上调用.
+type selfMetrics struct {
+	requestDuration *prometheus.HistogramVec // 每次请求的耗时
+	attempts        *prometheus.CounterVec   // 请求次数, 包括重试
+	failures        *prometheus.CounterVec   // 失败的请求次数, 按状态码类别区分
+	sentBytes       *prometheus.CounterVec   // 成功发送的请求体字节数, 为压缩后的大小
+	payloadBytes    *prometheus.CounterVec   // 压缩前的请求体字节数
+	writeSamples    *prometheus.HistogramVec // 每次写入的样本数
+	writeSeries     *prometheus.HistogramVec // 每次写入的时间序列数
+	lastSuccess     *prometheus.GaugeVec     // 最后一次请求成功的时间戳
+	writeQueues     *writeQueueCollector     // RemoteWrite 发送队列的指标
+}
+
+func newSelfMetrics() *selfMetrics {
+	sizeBuckets := prometheus.ExponentialBuckets(10, 4, 10)
+	return &selfMetrics{
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "metrics_exporter_request_duration_seconds",
+			Help: "metrics 发送器每次请求的耗时",
+		}, []string{"exporter", "target"}),
+		attempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "metrics_exporter_attempts_total",
+			Help: "metrics 发送器的请求次数, 包括重试",
+		}, []string{"exporter", "target"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "metrics_exporter_failures_total",
+			Help: "metrics 发送器失败的请求次数, status 为 4xx, 5xx, network 或 other",
+		}, []string{"exporter", "target", "status"}),
+		sentBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "metrics_exporter_sent_bytes_total",
+			Help: "metrics 发送器成功发送的请求体字节数, 启用压缩时为压缩后的大小",
+		}, []string{"exporter", "target"}),
+		payloadBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "metrics_exporter_payload_bytes_total",
+			Help: "metrics 发送器收集的数据压缩前的字节数",
+		}, []string{"exporter", "target"}),
+		writeSamples: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "metrics_exporter_write_samples",
+			Help:    "metrics 发送器每次写入的样本数",
+			Buckets: sizeBuckets,
+		}, []string{"exporter", "target"}),
+		writeSeries: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "metrics_exporter_write_series",
+			Help:    "metrics 发送器每次写入的时间序列数",
+			Buckets: sizeBuckets,
+		}, []string{"exporter", "target"}),
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "metrics_exporter_last_success_timestamp_seconds",
+			Help: "metrics 发送器最后一次请求成功的时间戳, 单位秒",
+		}, []string{"exporter", "target"}),
+		writeQueues: newWriteQueueCollector(),
+	}
+}
+
+func (m *selfMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.requestDuration, m.attempts, m.failures, m.sentBytes, m.payloadBytes,
+		m.writeSamples, m.writeSeries, m.lastSuccess, m.writeQueues,
+	}
+}
+
+// 替换导出指标的 RemoteWrite 发送队列, 用于启动和配置热更新后
+func (m *selfMetrics) setWriteQueues(targets []*writeTarget) {
+	if m == nil {
+		return
+	}
+	queues := make([]*writeQueue, 0, len(targets))
+	for _, t := range targets {
+		queues = append(queues, t.queue)
+	}
+	m.writeQueues.queues.Store(&queues)
+}
+
+// 记录一次请求, target 为 RemoteWrite 目标名称, push模式的 job 或 InfluxDB 的 bucket, size 为请求体大小
+func (m *selfMetrics) observeRequest(exporter, target string, start time.Time, size int, err error) {
+	if m == nil {
+		return
+	}
+	m.requestDuration.WithLabelValues(exporter, target).Observe(time.Since(start).Seconds())
+	m.attempts.WithLabelValues(exporter, target).Inc()
+	if err != nil {
+		m.failures.WithLabelValues(exporter, target, statusClass(err)).Inc()
+		return
+	}
+	m.sentBytes.WithLabelValues(exporter, target).Add(float64(size))
+	m.lastSuccess.WithLabelValues(exporter, target).Set(float64(time.Now().UnixMilli()) / 1e3)
+}
+
+// 记录一次写入收集的数据
+func (m *selfMetrics) observeWrite(exporter, target string, samples, series, payloadSize int) {
+	if m == nil {
+		return
+	}
+	m.writeSamples.WithLabelValues(exporter, target).Observe(float64(samples))
+	m.writeSeries.WithLabelValues(exporter, target).Observe(float64(series))
+	m.payloadBytes.WithLabelValues(exporter, target).Add(float64(payloadSize))
+}
+
+// 删除发送器目标的指标, 用于配置热更新后已移除的目标
+func (m *selfMetrics) deleteTarget(exporter, target string) {
+	if m == nil {
+		return
+	}
+	labels := prometheus.Labels{"exporter": exporter, "target": target}
+	m.requestDuration.DeletePartialMatch(labels)
+	m.attempts.DeletePartialMatch(labels)
+	m.failures.DeletePartialMatch(labels)
+	m.sentBytes.DeletePartialMatch(labels)
+	m.payloadBytes.DeletePartialMatch(labels)
+	m.writeSamples.DeletePartialMatch(labels)
+	m.writeSeries.DeletePartialMatch(labels)
+	m.lastSuccess.DeletePartialMatch(labels)
+}
+
+// 错误的状态码类别
+func statusClass(err error) string {
+	var writeErr *RemoteWriteError
+	if !errors.As(err, &writeErr) {
+		return "other"
+	}
+	if writeErr.StatusCode == 0 {
+		return "network"
+	}
+	return strconv.Itoa(writeErr.StatusCode/100) + "xx"
+}
+
+// 记录 push 模式每次请求的 http 客户端
+type selfMetricsDoer struct {
+	client   *http.Client
+	metrics  *selfMetrics
+	exporter string
+	target   string // push模式为 job
+}
+
+func (d *selfMetricsDoer) Do(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := d.client.Do(req)
+	switch {
+	case err != nil:
+		d.metrics.observeRequest(d.exporter, d.target, start, 0, &RemoteWriteError{Err: err})
+	case resp.StatusCode/100 != 2:
+		d.metrics.observeRequest(d.exporter, d.target, start, 0, &RemoteWriteError{StatusCode: resp.StatusCode, Err: errors.New(resp.Status)})
+	default:
+		d.metrics.observeRequest(d.exporter, d.target, start, int(req.ContentLength), nil)
+	}
+	return resp, err
+}
+
+// RemoteWrite 发送队列的指标
+//
+// 只在创建客户端时注册一次, 配置热更新时替换发送队列, 新的目标可以使用与原来的目标相同的标签.
+type writeQueueCollector struct {
+	queues          atomic.Pointer[[]*writeQueue]
+	depth           *prometheus.Desc
+	droppedRequests *prometheus.Desc
+	droppedSamples  *prometheus.Desc
+}
+
+func newWriteQueueCollector() *writeQueueCollector {
+	labels := []string{"exporter", "target"}
+	return &writeQueueCollector{
+		depth:           prometheus.NewDesc("metrics_exporter_queue_depth", "metrics 发送器等待发送的请求数, 启用预写日志时为预写日志中的记录数", labels, nil),
+		droppedRequests: prometheus.NewDesc("metrics_exporter_dropped_requests_total", "metrics 发送器丢弃的请求数", labels, nil),
+		droppedSamples:  prometheus.NewDesc("metrics_exporter_dropped_samples_total", "metrics 发送器丢弃的样本数", labels, nil),
+	}
+}
+
+func (c *writeQueueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.depth
+	ch <- c.droppedRequests
+	ch <- c.droppedSamples
+}
+
+func (c *writeQueueCollector) Collect(ch chan<- prometheus.Metric) {
+	queues := c.queues.Load()
+	if queues == nil {
+		return
+	}
+	for _, q := range *queues {
+		ch <- prometheus.MustNewConstMetric(c.depth, prometheus.GaugeValue, float64(q.Depth()), exporterRemoteWrite, q.conf.Name)
+		ch <- prometheus.MustNewConstMetric(c.droppedRequests, prometheus.CounterValue, float64(q.droppedRequests.Load()), exporterRemoteWrite, q.conf.Name)
+		ch <- prometheus.MustNewConstMetric(c.droppedSamples, prometheus.CounterValue, float64(q.droppedSamples.Load()), exporterRemoteWrite, q.conf.Name)
+	}
+}
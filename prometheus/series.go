@@ -0,0 +1,229 @@
+package prometheus
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/zly-app/zapp/component/metrics"
+	"github.com/zly-app/zapp/log"
+)
+
+// 可管理时间序列的指标, Counter, Gauge, Histogram, Summary 都实现了此接口
+//
+//	if s, ok := metrics.Gauge("name").(prometheus.SeriesManager); ok {
+//		s.Delete(metrics.Labels{"tenant": "a"})
+//	}
+type SeriesManager interface {
+	// 删除一组标签对应的时间序列, 返回是否存在
+	Delete(labels metrics.Labels) bool
+	// 删除所有时间序列
+	Reset()
+	// 设置时间序列过期时间, 超过这个时间未更新的时间序列会被删除, 0 表示不过期. 只对设置后更新的时间序列生效
+	SetTTL(ttl time.Duration)
+}
+
+// 超出时间序列数量限制后替换的标签值
+const seriesOverflowLabelValue = "__overflow__"
+
+const (
+	SeriesOverflowModeOverflow = "overflow" // 超出时间序列数量限制后计入所有标签值为 __overflow__ 的时间序列
+	SeriesOverflowModeDrop     = "drop"     // 超出时间序列数量限制后丢弃
+)
+
+// 时间序列管理
+type series struct {
+	name string
+	vec  *prometheus.MetricVec
+
+	limit    int                    // 时间序列数量限制, 0 表示不限制
+	drop     bool                   // 超出限制后丢弃
+	rejected *prometheus.CounterVec // 超出限制被拒绝的观测次数
+	warned   bool                   // 是否已报告超出限制
+
+	ttl     atomic.Int64 // 过期时间, 单位纳秒
+	mx      sync.Mutex
+	tracked map[string]*seriesEntry // 设置了过期时间或数量限制后记录的时间序列
+}
+
+type seriesEntry struct {
+	labels   prometheus.Labels
+	lastSeen int64
+}
+
+func newSeries(name string, vec *prometheus.MetricVec) *series {
+	return &series{
+		name:    name,
+		vec:     vec,
+		tracked: make(map[string]*seriesEntry),
+	}
+}
+
+func (s *series) Delete(labels metrics.Labels) bool {
+	s.mx.Lock()
+	delete(s.tracked, labelsKey(labels))
+	s.mx.Unlock()
+	return s.vec.Delete(prometheus.Labels(labels))
+}
+
+func (s *series) Reset() {
+	s.mx.Lock()
+	s.tracked = make(map[string]*seriesEntry)
+	s.mx.Unlock()
+	s.vec.Reset()
+}
+
+func (s *series) SetTTL(ttl time.Duration) {
+	s.ttl.Store(int64(ttl))
+	if ttl <= 0 && s.limit <= 0 {
+		s.mx.Lock()
+		s.tracked = make(map[string]*seriesEntry)
+		s.mx.Unlock()
+	}
+}
+
+// 设置时间序列数量限制, 需要在使用前设置
+func (s *series) setLimit(limit int, mode string, rejected *prometheus.CounterVec) {
+	s.limit = limit
+	s.drop = mode == SeriesOverflowModeDrop
+	s.rejected = rejected
+}
+
+// 准入时间序列, 返回实际使用的标签, 如果需要丢弃则返回 false.
+// 会记录时间序列的更新时间, 需要在更新时间序列之前调用, 避免刚更新的时间序列被删除.
+func (s *series) admit(labels metrics.Labels) (metrics.Labels, bool) {
+	if s.ttl.Load() <= 0 && s.limit <= 0 {
+		return labels, true
+	}
+	key := labelsKey(labels)
+	now := time.Now().UnixNano()
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if e, ok := s.tracked[key]; ok {
+		e.lastSeen = now
+		return labels, true
+	}
+
+	if s.limit > 0 && len(s.tracked) >= s.limit {
+		action := SeriesOverflowModeOverflow
+		if s.drop {
+			action = SeriesOverflowModeDrop
+		}
+		s.rejected.WithLabelValues(s.name, action).Inc()
+		if !s.warned {
+			s.warned = true
+			log.Warn("metrics 时间序列数量超出限制", zap.String("name", s.name), zap.Int("limit", s.limit), zap.String("action", action))
+		}
+		if s.drop {
+			return nil, false
+		}
+		overflow := make(metrics.Labels, len(labels))
+		for k := range labels {
+			overflow[k] = seriesOverflowLabelValue
+		}
+		return overflow, true // 溢出的时间序列不计入数量限制
+	}
+
+	l := make(prometheus.Labels, len(labels))
+	for k, v := range labels {
+		l[k] = v
+	}
+	if _, err := s.vec.GetMetricWith(l); err != nil { // 标签错误的时间序列不记录, 由调用方报告错误
+		return labels, true
+	}
+	s.tracked[key] = &seriesEntry{labels: l, lastSeen: now}
+	return labels, true
+}
+
+// 删除过期的时间序列, 返回删除的数量
+func (s *series) expire(now time.Time) int {
+	ttl := s.ttl.Load()
+	if ttl <= 0 {
+		return 0
+	}
+	deadline := now.UnixNano() - ttl
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	n := 0
+	for key, e := range s.tracked {
+		if e.lastSeen > deadline {
+			continue
+		}
+		delete(s.tracked, key)
+		if s.vec.Delete(e.labels) {
+			n++
+		}
+	}
+	return n
+}
+
+func labelsKey(labels metrics.Labels) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for _, k := range keys {
+		sb.WriteString(k)
+		sb.WriteByte(0xff)
+		sb.WriteString(labels[k])
+		sb.WriteByte(0xff)
+	}
+	return sb.String()
+}
+
+// 添加需要管理的时间序列
+func (p *Client) addSeries(s *series) {
+	limit := p.conf.SeriesLimit
+	if l, ok := p.conf.SeriesLimits[s.name]; ok {
+		limit = l
+	}
+	s.setLimit(limit, p.conf.SeriesOverflowMode, p.rejectedSeries)
+	if ttl, ok := p.conf.SeriesTTL[s.name]; ok {
+		s.SetTTL(time.Duration(ttl) * time.Millisecond)
+	}
+
+	p.seriesLocker.Lock()
+	p.series = append(p.series, s)
+	p.seriesLocker.Unlock()
+}
+
+// 启动过期时间序列检查
+func (p *Client) startSeriesExpire(conf *Config) {
+	p.wg.Add(1)
+	go func(ctx context.Context, interval time.Duration) {
+		defer p.wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-t.C:
+				p.expireSeries(now)
+			}
+		}
+	}(p.ctx, time.Duration(conf.SeriesExpireInterval)*time.Millisecond)
+}
+
+func (p *Client) expireSeries(now time.Time) {
+	p.seriesLocker.RLock()
+	list := append([]*series(nil), p.series...)
+	p.seriesLocker.RUnlock()
+
+	for _, s := range list {
+		if n := s.expire(now); n > 0 {
+			p.app.Debug("metrics 删除过期的时间序列", zap.String("name", s.name), zap.Int("count", n))
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package prometheus
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	io_prometheus_client "github.com/prometheus/client_model/go"
+)
+
+const (
+	StatsdFormatStatsd    = "statsd"    // 标签格式为 name,k=v:1|c, 如 Telegraf
+	StatsdFormatDogStatsd = "dogstatsd" // 标签格式为 name:1|c|#k:v
+)
+
+// StatsD 发送器
+//
+// 定时从收集器收集数据并转换为 StatsD 行协议, 通过 UDP 或 Unix socket 发送.
+// 计数器, 直方图和汇总的 _sum, _count 发送两次收集之间的增量(|c), 计量器和汇总的分位数发送当前值(|g).
+// 直方图的分桶无法在 StatsD 中聚合, 且每个分桶会增加一个标签值, 所以不发送.
+type statsdSink struct {
+	gatherer      prometheus.Gatherer
+	conn          net.Conn
+	dogStatsd     bool
+	prefix        string
+	maxPacketSize int
+	tags          map[string]string // 附加的标签
+
+	mx   sync.Mutex
+	last map[string]float64 // 计数器上一次的值, 用于计算增量. 每次收集后只保留本次出现的时间序列
+	next map[string]float64 // 本次收集的计数器的值
+}
+
+func newStatsdSink(conf *Config, gatherer prometheus.Gatherer, tags map[string]string) (*statsdSink, error) {
+	network, address := "udp", conf.StatsdAddress
+	switch {
+	case strings.HasPrefix(address, "unix://"):
+		network, address = "unixgram", strings.TrimPrefix(address, "unix://")
+	case strings.HasPrefix(address, "udp://"):
+		address = strings.TrimPrefix(address, "udp://")
+	}
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("dial statsd %s %s err: %v", network, address, err)
+	}
+	return &statsdSink{
+		gatherer:      gatherer,
+		conn:          conn,
+		dogStatsd:     conf.StatsdFormat == StatsdFormatDogStatsd,
+		prefix:        conf.StatsdPrefix,
+		maxPacketSize: conf.StatsdMaxPacketSize,
+		tags:          tags,
+		last:          make(map[string]float64),
+	}, nil
+}
+
+// 收集并发送一次数据
+func (s *statsdSink) Flush() error {
+	mfs, err := s.gatherer.Gather()
+	if err != nil && len(mfs) == 0 {
+		return err
+	}
+
+	s.mx.Lock()
+	s.next = make(map[string]float64, len(s.last))
+	lines := s.lines(mfs)
+	s.last, s.next = s.next, nil // 已删除或过期的时间序列不再保留, 重新出现时按计数器重置处理
+	s.mx.Unlock()
+
+	var sendErr error
+	splitPackets(lines, s.maxPacketSize, func(packet []byte) {
+		if _, err := s.conn.Write(packet); err != nil && sendErr == nil {
+			sendErr = err
+		}
+	})
+	if sendErr != nil {
+		return fmt.Errorf("send statsd packet err: %v", sendErr)
+	}
+	return err
+}
+
+func (s *statsdSink) Close() error {
+	return s.conn.Close()
+}
+
+func (s *statsdSink) lines(mfs []*io_prometheus_client.MetricFamily) []string {
+	lines := make([]string, 0, len(mfs))
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			switch mf.GetType() {
+			case io_prometheus_client.MetricType_COUNTER:
+				lines = s.appendDelta(lines, name, m.GetLabel(), m.GetCounter().GetValue())
+			case io_prometheus_client.MetricType_GAUGE:
+				lines = s.appendGauge(lines, name, m.GetLabel(), m.GetGauge().GetValue())
+			case io_prometheus_client.MetricType_UNTYPED:
+				lines = s.appendGauge(lines, name, m.GetLabel(), m.GetUntyped().GetValue())
+			case io_prometheus_client.MetricType_SUMMARY:
+				summary := m.GetSummary()
+				for _, q := range summary.GetQuantile() {
+					lines = s.appendGauge(lines, name, m.GetLabel(), q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+				}
+				lines = s.appendDelta(lines, name+"_sum", m.GetLabel(), summary.GetSampleSum())
+				lines = s.appendDelta(lines, name+"_count", m.GetLabel(), float64(summary.GetSampleCount()))
+			case io_prometheus_client.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				count := float64(h.GetSampleCount())
+				if h.GetSampleCountFloat() > 0 {
+					count = h.GetSampleCountFloat()
+				}
+				lines = s.appendDelta(lines, name+"_sum", m.GetLabel(), h.GetSampleSum())
+				lines = s.appendDelta(lines, name+"_count", m.GetLabel(), count)
+			}
+		}
+	}
+	return lines
+}
+
+func (s *statsdSink) appendGauge(lines []string, name string, labels []*io_prometheus_client.LabelPair, v float64, extra ...string) []string {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return lines
+	}
+	return append(lines, s.line(name, s.tagsOf(labels, extra...), v, "g"))
+}
+
+// 发送与上一次收集的增量, 计数器重置后发送当前值
+func (s *statsdSink) appendDelta(lines []string, name string, labels []*io_prometheus_client.LabelPair, v float64, extra ...string) []string {
+	tags := s.tagsOf(labels, extra...)
+	key := name + "\xff" + strings.Join(tags, "\xff")
+	last, ok := s.last[key]
+	s.next[key] = v
+
+	delta := v
+	if ok && v >= last {
+		delta = v - last
+	}
+	if delta == 0 || math.IsNaN(delta) {
+		return lines
+	}
+	return append(lines, s.line(name, tags, delta, "c"))
+}
+
+// 生成按名称排序的标签, 格式为 k=v, 指标已有的标签优先于附加的标签
+func (s *statsdSink) tagsOf(labels []*io_prometheus_client.LabelPair, extra ...string) []string {
+	all := make(map[string]string, len(s.tags)+len(labels)+len(extra)/2)
+	for k, v := range s.tags {
+		all[k] = v
+	}
+	for _, l := range labels {
+		all[l.GetName()] = l.GetValue()
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		all[extra[i]] = extra[i+1]
+	}
+
+	tags := make([]string, 0, len(all))
+	for k, v := range all {
+		if v == "" {
+			continue
+		}
+		tags = append(tags, statsdEscape(k)+"="+statsdEscape(v))
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func (s *statsdSink) line(name string, tags []string, v float64, typ string) string {
+	var sb strings.Builder
+	sb.WriteString(statsdEscape(s.prefix + name))
+	if !s.dogStatsd {
+		for _, t := range tags {
+			sb.WriteByte(',')
+			sb.WriteString(t)
+		}
+	}
+	sb.WriteByte(':')
+	sb.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+	sb.WriteByte('|')
+	sb.WriteString(typ)
+	if s.dogStatsd && len(tags) > 0 {
+		sb.WriteString("|#")
+		for i, t := range tags {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			sb.WriteString(strings.Replace(t, "=", ":", 1))
+		}
+	}
+	return sb.String()
+}
+
+// 按最大包大小将多行合并为一个包, 单行超过最大包大小时独占一个包
+func splitPackets(lines []string, maxPacketSize int, fn func(packet []byte)) {
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+1+len(line) > maxPacketSize {
+			fn(buf.Bytes())
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() > 0 {
+		fn(buf.Bytes())
+	}
+}
+
+var statsdReplacer = strings.NewReplacer(",", "_", "|", "_", "#", "_", ":", "_", "=", "_", " ", "_", "\n", "_")
+
+func statsdEscape(s string) string {
+	return statsdReplacer.Replace(s)
+}
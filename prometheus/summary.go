@@ -0,0 +1,108 @@
+package prometheus
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/zly-app/zapp/component/metrics"
+)
+
+// 默认分位数 p50, p90, p99
+var defaultSummaryObjectives = []SummaryObjective{
+	{Quantile: 0.5, Error: 0.05},
+	{Quantile: 0.9, Error: 0.01},
+	{Quantile: 0.99, Error: 0.001},
+}
+
+// 汇总配置
+type SummaryConfig struct {
+	Objectives []SummaryObjective // 分位数及其允许的误差, 如果为空则使用 p50, p90, p99
+	MaxAge     int64              // 观测值的保留时间, 单位毫秒, 分位数按这段时间内的观测值计算, 默认为 10 分钟
+	AgeBuckets uint32             // 保留时间内滑动窗口的桶数, 默认为 5
+}
+
+// 分位数
+type SummaryObjective struct {
+	Quantile float64 // 分位数, 如: 0.99
+	Error    float64 // 允许的误差, 如: 0.001
+}
+
+func (c *SummaryConfig) check() error {
+	if len(c.Objectives) == 0 {
+		c.Objectives = defaultSummaryObjectives
+	}
+	for _, o := range c.Objectives {
+		if o.Quantile < 0 || o.Quantile > 1 {
+			return fmt.Errorf("summary objective quantile must be in [0, 1], got %v", o.Quantile)
+		}
+		if o.Error < 0 || o.Error > 1 {
+			return fmt.Errorf("summary objective error must be in [0, 1], got %v", o.Error)
+		}
+	}
+	if c.MaxAge < 1 {
+		c.MaxAge = prometheus.DefMaxAge.Milliseconds()
+	}
+	if c.AgeBuckets < 1 {
+		c.AgeBuckets = prometheus.DefAgeBuckets
+	}
+	return nil
+}
+
+func (c *SummaryConfig) apply(opts *prometheus.SummaryOpts) {
+	opts.Objectives = make(map[float64]float64, len(c.Objectives))
+	for _, o := range c.Objectives {
+		opts.Objectives[o.Quantile] = o.Error
+	}
+	opts.MaxAge = time.Duration(c.MaxAge) * time.Millisecond
+	opts.AgeBuckets = c.AgeBuckets
+}
+
+func (p *Client) RegistrySummaryWithConfig(name, help string, summary SummaryConfig, constLabels metrics.Labels, labels ...string) metrics.ISummary {
+	s, err := p.TryRegistrySummaryWithConfig(name, help, summary, constLabels, labels...)
+	if err != nil {
+		p.app.Fatal("注册 metrics Summary 汇总失败", zap.String("name", name), zap.Error(err))
+	}
+	return s
+}
+
+// 按配置注册汇总, 重复注册的行为与 TryRegistrySummary 一致
+func (p *Client) TryRegistrySummaryWithConfig(name, help string, summary SummaryConfig, constLabels metrics.Labels, labels ...string) (metrics.ISummary, error) {
+	p.summaryCollectorLocker.Lock()
+	defer p.summaryCollectorLocker.Unlock()
+
+	if err := summary.check(); err != nil {
+		return nil, fmt.Errorf("registry metrics Summary %q err: %w", name, err)
+	}
+	sign := newMetricSignature(metricTypeSummary, help, nil, constLabels, labels)
+	sign.opts = fmt.Sprintf("%+v", summary)
+	err := p.claimMetricName(name, sign)
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := p.summaryCollector[name]; ok {
+		return s, nil
+	}
+
+	opts := prometheus.SummaryOpts{
+		Namespace:   "",
+		Subsystem:   "",
+		Name:        name,
+		Help:        help,
+		ConstLabels: constLabels,
+	}
+	summary.apply(&opts)
+	vec := prometheus.NewSummaryVec(opts, labels)
+	err = p.registryCollector(vec)
+	if err != nil {
+		p.releaseMetricName(name)
+		return nil, fmt.Errorf("registry metrics Summary %q err: %w", name, err)
+	}
+
+	s := &summaryCli{series: newSeries(name, vec.MetricVec), name: name, summary: vec}
+	p.addSeries(s.series)
+	p.summaryCollector[name] = s
+	return s, nil
+}
@@ -0,0 +1,263 @@
+package prometheus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	walFileExt    = ".wal"
+	walTmpFileExt = ".tmp"
+
+	walHeaderSize = 7 // 协议版本(1) + 分片(2) + 样本数(4)
+
+	walReplayShard = -1 // 打开时已存在的记录所在的分片
+)
+
+// RemoteWrite 预写日志记录
+type walRecord struct {
+	seq     uint64
+	shard   int
+	samples int
+	size    int64
+	sending bool // 正在发送, 不会因超出大小限制被丢弃
+}
+
+// RemoteWrite 预写日志
+//
+// 每个待发送的请求保存为目录下的一个文件, 文件名为递增序号, 发送成功后删除.
+// 文件内容为 walHeaderSize 字节的头部, 之后为 snappy 压缩后的请求体.
+// 各个分片的记录互相独立, 同一分片内按序号顺序重放.
+// 打开时已存在的记录统一放入 walReplayShard, 分片数可能已变化, 需要在发送新的数据前按序号顺序重放.
+type writeWAL struct {
+	dir     string
+	maxSize int64
+
+	mx      sync.Mutex
+	seq     uint64
+	records []walRecord // 按序号升序
+	size    int64
+}
+
+func openWriteWAL(dir string, maxSize int64) (*writeWAL, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("create wal dir failed: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read wal dir failed: %v", err)
+	}
+
+	w := &writeWAL{dir: dir, maxSize: maxSize}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		name := e.Name()
+		if strings.HasSuffix(name, walTmpFileExt) { // 未写完的文件
+			_ = os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, walFileExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, walFileExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		r, err := w.readRecordHeader(seq)
+		if err != nil { // 损坏的记录
+			_ = os.Remove(w.path(seq))
+			continue
+		}
+		r.shard = walReplayShard
+		w.records = append(w.records, r)
+		w.size += r.size
+		if seq > w.seq {
+			w.seq = seq
+		}
+	}
+	sort.Slice(w.records, func(i, j int) bool { return w.records[i].seq < w.records[j].seq })
+	return w, nil
+}
+
+func (w *writeWAL) path(seq uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%020d%s", seq, walFileExt))
+}
+
+func (w *writeWAL) readRecordHeader(seq uint64) (walRecord, error) {
+	f, err := os.Open(w.path(seq))
+	if err != nil {
+		return walRecord{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return walRecord{}, err
+	}
+	header := make([]byte, walHeaderSize)
+	if _, err = io.ReadFull(f, header); err != nil {
+		return walRecord{}, err
+	}
+	return walRecord{
+		seq:     seq,
+		shard:   int(binary.BigEndian.Uint16(header[1:3])),
+		samples: int(binary.BigEndian.Uint32(header[3:7])),
+		size:    info.Size(),
+	}, nil
+}
+
+// 追加一条记录, 返回因超出磁盘大小限制而丢弃的最旧记录
+func (w *writeWAL) Append(shard int, protocolVersion string, batch writeBatch) ([]walRecord, error) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	seq := w.seq + 1
+	data := make([]byte, walHeaderSize, walHeaderSize+len(batch.body))
+	data[0] = walProtocolByte(protocolVersion)
+	binary.BigEndian.PutUint16(data[1:3], uint16(shard))
+	binary.BigEndian.PutUint32(data[3:7], uint32(batch.samples))
+	data = append(data, batch.body...)
+
+	path := w.path(seq)
+	tmp := path + walTmpFileExt
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return nil, err
+	}
+
+	w.seq = seq
+	w.records = append(w.records, walRecord{seq: seq, shard: shard, samples: batch.samples, size: int64(len(data))})
+	w.size += int64(len(data))
+
+	// 保留刚写入的记录, 跳过正在发送的记录
+	var dropped []walRecord
+	for i := 0; w.maxSize > 0 && w.size > w.maxSize && i < len(w.records)-1; {
+		r := w.records[i]
+		if r.sending {
+			i++
+			continue
+		}
+		dropped = append(dropped, r)
+		w.removeLocked(r.seq)
+	}
+	return dropped, nil
+}
+
+// 获取分片中最旧的一条记录并标记为正在发送, 发送后需要调用 Remove 或 Release
+func (w *writeWAL) Peek(shard int) (record walRecord, protocolVersion string, body []byte, ok bool, err error) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	for i := 0; i < len(w.records); {
+		r := w.records[i]
+		if r.shard != shard {
+			i++
+			continue
+		}
+		data, err := os.ReadFile(w.path(r.seq))
+		if os.IsNotExist(err) {
+			w.removeLocked(r.seq)
+			continue
+		}
+		if err != nil {
+			return walRecord{}, "", nil, false, err
+		}
+		if len(data) < walHeaderSize { // 损坏的记录
+			w.removeLocked(r.seq)
+			continue
+		}
+		w.records[i].sending = true
+		return r, walProtocolVersion(data[0]), data[walHeaderSize:], true, nil
+	}
+	return walRecord{}, "", nil, false, nil
+}
+
+// 删除记录
+func (w *writeWAL) Remove(seq uint64) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	w.removeLocked(seq)
+}
+
+// 发送失败后保留记录等待重放, 之后可以被丢弃
+func (w *writeWAL) Release(seq uint64) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	for i := range w.records {
+		if w.records[i].seq == seq {
+			w.records[i].sending = false
+			return
+		}
+	}
+}
+
+func (w *writeWAL) removeLocked(seq uint64) {
+	for i, r := range w.records {
+		if r.seq == seq {
+			_ = os.Remove(w.path(seq))
+			w.size -= r.size
+			w.records = append(w.records[:i], w.records[i+1:]...)
+			return
+		}
+	}
+}
+
+// 将所有记录放入 walReplayShard, 复用预写日志且分片数可能变化时在发送新的数据前按序号顺序重放
+func (w *writeWAL) resetShards() {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	for i := range w.records {
+		w.records[i].shard = walReplayShard
+	}
+}
+
+func (w *writeWAL) setMaxSize(maxSize int64) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	w.maxSize = maxSize
+}
+
+// 记录数
+func (w *writeWAL) Len() int {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	return len(w.records)
+}
+
+func walProtocolByte(protocolVersion string) byte {
+	if protocolVersion == RemoteWriteProtocolV2 {
+		return 2
+	}
+	return 1
+}
+
+func walProtocolVersion(b byte) string {
+	if b == 2 {
+		return RemoteWriteProtocolV2
+	}
+	return RemoteWriteProtocolV1
+}
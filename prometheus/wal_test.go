@@ -0,0 +1,216 @@
+package prometheus
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestWriteWALReplayAfterRestart(t *testing.T) {
+	srv := startTestReceiver(testResponse{code: http.StatusServiceUnavailable})
+	defer srv.Close()
+	dir := t.TempDir()
+
+	q := newTestWriteQueue(t, srv.URL, func(conf *RemoteWriteConfig) { conf.WALDir = dir })
+	if err := q.Write(context.Background()); err == nil {
+		t.Fatalf("write err = nil, want 503")
+	}
+	failed := srv.received(t)
+	if len(failed) != 1 {
+		t.Fatalf("received %d requests, want 1", len(failed))
+	}
+	if n := q.wal.Len(); n != 1 {
+		t.Fatalf("wal len after failed send = %d, want 1", n)
+	}
+
+	// 重新打开目录模拟进程重启, 先重放保留的数据再发送新的数据
+	q = newTestWriteQueue(t, srv.URL, func(conf *RemoteWriteConfig) { conf.WALDir = dir })
+	if n := q.wal.Len(); n != 1 {
+		t.Fatalf("wal len after reopen = %d, want 1", n)
+	}
+	if err := q.Write(context.Background()); err != nil {
+		t.Fatalf("write err: %v", err)
+	}
+	got := srv.received(t)
+	if len(got) != 2 {
+		t.Fatalf("received %d requests, want 2", len(got))
+	}
+	if !bytes.Equal(got[0].body, failed[0].body) {
+		t.Errorf("first request is not the replayed data")
+	}
+	if n := q.wal.Len(); n != 0 {
+		t.Errorf("wal len after successful send = %d, want 0", n)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("wal dir has %d files after successful send, want 0", len(entries))
+	}
+}
+
+func TestWriteWALDropUnrecoverable(t *testing.T) {
+	srv := startTestReceiver(testResponse{code: http.StatusBadRequest})
+	defer srv.Close()
+
+	q := newTestWriteQueue(t, srv.URL, func(conf *RemoteWriteConfig) { conf.WALDir = t.TempDir() })
+	if err := q.Write(context.Background()); err == nil {
+		t.Fatalf("write err = nil, want 400")
+	}
+	if n := q.wal.Len(); n != 0 {
+		t.Errorf("wal len = %d, want 0", n)
+	}
+	if n := q.droppedRequests.Load(); n != 1 {
+		t.Errorf("dropped requests = %d, want 1", n)
+	}
+}
+
+func TestWriteWALSizeLimit(t *testing.T) {
+	dir := t.TempDir()
+	batch := writeBatch{body: make([]byte, 100), samples: 1}
+	recordSize := int64(walHeaderSize + len(batch.body))
+
+	w, err := openWriteWAL(dir, 2*recordSize)
+	if err != nil {
+		t.Fatalf("open wal err: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		dropped, err := w.Append(0, RemoteWriteProtocolV1, batch)
+		if err != nil || len(dropped) != 0 {
+			t.Fatalf("append %d: dropped %v, err %v", i, dropped, err)
+		}
+	}
+	dropped, err := w.Append(0, RemoteWriteProtocolV1, batch)
+	if err != nil {
+		t.Fatalf("append err: %v", err)
+	}
+	if len(dropped) != 1 || dropped[0].seq != 1 {
+		t.Fatalf("dropped = %v, want oldest record 1", dropped)
+	}
+	if _, err := os.Stat(w.path(1)); !os.IsNotExist(err) {
+		t.Errorf("oldest wal file still exists")
+	}
+
+	w, err = openWriteWAL(dir, 2*recordSize)
+	if err != nil {
+		t.Fatalf("reopen wal err: %v", err)
+	}
+	record, _, _, ok, err := w.Peek(walReplayShard)
+	if err != nil || !ok || record.seq != 2 || w.Len() != 2 {
+		t.Errorf("after reopen: first seq %d, len %d, ok %v, err %v; want seq 2, len 2", record.seq, w.Len(), ok, err)
+	}
+}
+
+func TestWriteWALReplayOrderAfterReshard(t *testing.T) {
+	unavailable := testResponse{code: http.StatusServiceUnavailable}
+	srv := startTestReceiver(unavailable, unavailable, unavailable, unavailable)
+	defer srv.Close()
+	dir := t.TempDir()
+
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_resharded", Help: "gauge"}, []string{"k"})
+	for i := 0; i < 3; i++ {
+		gauge.WithLabelValues(strconv.Itoa(i)).Set(float64(i))
+	}
+	newQueue := func(shards int) *writeQueue {
+		q := newTestWriteQueue(t, srv.URL, func(conf *RemoteWriteConfig) {
+			conf.WALDir = dir
+			conf.Shards = shards
+			conf.MaxSamplesPerSend = 1
+		})
+		q.write.Collector(gauge)
+		return q
+	}
+
+	q := newQueue(4)
+	if err := q.Write(context.Background()); err == nil {
+		t.Fatalf("write err = nil, want 503")
+	}
+	srv.received(t)
+	srv.mx.Lock()
+	srv.responses = nil
+	srv.mx.Unlock()
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 4 {
+		t.Fatalf("wal dir has %d files, err %v; want 4", len(entries), err)
+	}
+	var retained [][]byte // 按序号排列的保留数据
+	for _, e := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatalf("read wal file err: %v", err)
+		}
+		body, err := snappy.Decode(nil, data[walHeaderSize:])
+		if err != nil {
+			t.Fatalf("snappy decode err: %v", err)
+		}
+		retained = append(retained, body)
+	}
+
+	// 分片数变化后先按原顺序重放保留的数据, 再并发发送新的数据
+	q = newQueue(2)
+	if err := q.Write(context.Background()); err != nil {
+		t.Fatalf("write err: %v", err)
+	}
+	got := srv.received(t)
+	if len(got) != 8 {
+		t.Fatalf("received %d requests, want 8", len(got))
+	}
+	for i, body := range retained {
+		if !bytes.Equal(got[i].body, body) {
+			t.Errorf("request %d is not retained record %d", i, i)
+		}
+	}
+	if n := q.wal.Len(); n != 0 {
+		t.Errorf("wal len = %d, want 0", n)
+	}
+}
+
+func TestWriteWALSizeLimitSkipsSending(t *testing.T) {
+	batch := writeBatch{body: make([]byte, 100), samples: 1}
+	recordSize := int64(walHeaderSize + len(batch.body))
+
+	w, err := openWriteWAL(t.TempDir(), 2*recordSize)
+	if err != nil {
+		t.Fatalf("open wal err: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := w.Append(0, RemoteWriteProtocolV1, batch); err != nil {
+			t.Fatalf("append %d err: %v", i, err)
+		}
+	}
+	record, _, _, ok, err := w.Peek(0)
+	if err != nil || !ok || record.seq != 1 {
+		t.Fatalf("peek: seq %d, ok %v, err %v; want seq 1", record.seq, ok, err)
+	}
+
+	// 正在发送的记录不会被丢弃
+	dropped, err := w.Append(0, RemoteWriteProtocolV1, batch)
+	if err != nil {
+		t.Fatalf("append err: %v", err)
+	}
+	if len(dropped) != 1 || dropped[0].seq != 2 {
+		t.Fatalf("dropped = %v, want record 2", dropped)
+	}
+	w.Remove(record.seq)
+	if n := w.Len(); n != 1 {
+		t.Fatalf("wal len = %d, want 1", n)
+	}
+
+	// 发送失败释放后可以被丢弃
+	record, _, _, _, _ = w.Peek(0)
+	w.Release(record.seq)
+	if _, err = w.Append(0, RemoteWriteProtocolV1, batch); err != nil {
+		t.Fatalf("append err: %v", err)
+	}
+	dropped, err = w.Append(0, RemoteWriteProtocolV1, batch)
+	if err != nil {
+		t.Fatalf("append err: %v", err)
+	}
+	if len(dropped) != 1 || dropped[0].seq != record.seq {
+		t.Errorf("dropped = %v, want released record %d", dropped, record.seq)
+	}
+}